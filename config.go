@@ -0,0 +1,1255 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/mail"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type Config struct {
+	SMTPHost          string
+	SMTPPort          string
+	SMTPUsername      string
+	SMTPPassword      string
+	SendmailPath      string
+	AppName           string
+	MailFrom          string
+	MailTo            string
+	ReplyTo           string
+	ExtraHeaders      []header
+	AlertHeader       string // HTML at the top of the email body
+	AlertFooter       string // HTML at the bottom of the email body
+	Plaintext         bool   // send text/plain emails without the template
+	SlackWebhookURL   string
+	DiscordWebhookURL string
+	SocketPath        string
+	DesktopNotify     bool
+	WebhookURL        string
+	WebhookTemplate   *template.Template
+	Webhooks          []webhookDestination // ERMON_WEBHOOK_<n>_URL
+	KafkaBrokers      []string             // host:port
+	KafkaTopic        string
+	GitHubToken       string
+	GitHubRepo        string // owner/name
+	GitHubLabel       string
+	GitHubAPIURL      string
+	EmailEnabled      bool
+	SlackEnabled      bool
+	DiscordEnabled    bool
+	SocketEnabled     bool
+	WebhookEnabled    bool // both ERMON_WEBHOOK_URL and ERMON_WEBHOOK_<n>_URL
+	GitHubEnabled     bool
+	KafkaEnabled      bool
+	MaxEmailsPerHour  int
+	// ConsecutiveThreshold is the number of errors without a reset in between
+	// that have to occur within ConsecutiveWindow before an alert is sent
+	ConsecutiveThreshold int
+	ConsecutiveWindow    time.Duration
+	// RateThreshold is the number of errors per minute, averaged over RateWindow, above which an alert is sent
+	RateThreshold float64
+	RateWindow    time.Duration
+	// SampleRate is the share of matched lines that are alerted, per rule
+	SampleRate float64
+	// AlertOnce sends only the first alert of an incident, until a reset line or AlertOnceTimeout without errors
+	AlertOnce        bool
+	AlertOnceTimeout time.Duration
+	BurstWindow      time.Duration
+	MaxBufferAge     time.Duration
+	RecoveryWindow   time.Duration
+	ErrorWindow      time.Duration // the batch is closed after this time without errors
+	InitialDelay     time.Duration
+	SilenceTimeout   time.Duration
+	// ExpectRate is the minimum number of lines matching SuccessPattern within ExpectRateWindow
+	ExpectRate       int
+	ExpectRateWindow time.Duration
+	MaxRuntime       time.Duration
+	ShutdownTimeout  time.Duration
+	// BreakerFailures is the number of consecutive failures after which sending is paused for BreakerCooldown
+	BreakerFailures int
+	BreakerCooldown time.Duration
+	// SendConcurrency is the number of channels an alert is sent through at the same time
+	SendConcurrency int
+	MaxBodyBytes    int
+	// EchoSample echoes one in EchoSample lines of the input, 0 disables the echo
+	EchoSample int
+	Verbosity  int
+	// SpoolDir keeps the alerts that failed to send, so they are retried later and after restarts
+	SpoolDir            string
+	SpoolMax            int
+	StatsdAddr          string
+	HTTPAddr            string
+	StatsdPrefix        string
+	StatsdInterval      time.Duration
+	Location            *time.Location // timezone used to render times
+	Rules               []rule
+	IgnorePattern       *regexp.Regexp
+	IgnoreBlockStart    *regexp.Regexp // matched lines from a line matching it to a line matching IgnoreBlockEnd are ignored
+	IgnoreBlockEnd      *regexp.Regexp
+	WarningPattern      *regexp.Regexp
+	ResetPattern        *regexp.Regexp
+	RedactPattern       *regexp.Regexp
+	SuccessPattern      *regexp.Regexp // lines of successful work, see ExpectRate
+	ContextEndPattern   *regexp.Regexp
+	HighlightPattern    *regexp.Regexp
+	ThreadPattern       *regexp.Regexp
+	GroupBy             string // name of the capture group to count the matched lines by
+	TypePattern         *regexp.Regexp
+	ShowIgnoredCount    bool
+	StripANSI           bool
+	LineTransforms      []lineTransform
+	StoreTransformed    bool // add the transformed lines to the alerts instead of the original ones
+	KeepBlankLines      bool
+	FoldDuplicates      bool
+	SummaryOnly         bool
+	FailOnAlert         bool
+	SendOnExit          bool   // send everything that is buffered when the input ends
+	CrashGrace          string // "always", "crash" or "off"
+	SanitizeUTF8        bool
+	MatchWorkers        int // number of goroutines matching the lines
+	SampleHead          int // number of first lines of a batch to show when it's too long
+	SampleTail          int // number of last lines of a batch to show when it's too long
+	HistoryLines        int
+	FlushThresholdLines int  // number of lines after which the batch is closed
+	JSONMultiline       bool // whether to join the lines of pretty-printed JSON objects
+	JSONMaxLines        int  // number of lines after which an unclosed JSON object is given up
+	MatchMinLen         int
+	MatchMaxLen         int
+	LogFiles            []string
+	JournalUnit         string // systemd unit to read from the journal instead of stdin
+	SourceLabel         string
+	MatchStream         string
+	LineSplit           string
+	ShowSource          bool
+	MaintenanceUntil    time.Time
+	MaintenanceFile     string
+	MaintenanceSummary  bool
+	ShowLineNumbers     bool
+	BlockOnOverflow     bool
+	SubjectTitle        bool
+	SubjectDelta        bool
+	AlertDelta          bool
+	TitleStripPattern   *regexp.Regexp
+	SeverityPrefix      string
+	ShowTrigger         bool
+	EmailThreading      bool
+	Profile             string
+}
+
+// rule is a match pattern with an optional human-readable name
+type rule struct {
+	name         string
+	patterns     []*regexp.Regexp // the line must match all of them
+	slackWebhook string           // overrides SLACK_WEBHOOK_URL for the lines matching the rule
+	escalation   *escalation      // see ERMON_RULE_ESCALATIONS
+}
+
+// compiled patterns by their source, so reading the config again doesn't recompile the patterns that didn't change
+var patternCache = map[string]*regexp.Regexp{}
+var patternCacheMutex sync.Mutex
+
+// compilePattern is regexp.Compile with a cache, a compiled regexp is safe to share between the configs
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	patternCacheMutex.Lock()
+	defer patternCacheMutex.Unlock()
+	if compiled, ok := patternCache[pattern]; ok {
+		return compiled, nil
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patternCache[pattern] = compiled
+	return compiled, nil
+}
+
+// String returns the name of the rule, or its patterns if it has no name
+func (r rule) String() string {
+	if r.name != "" {
+		return r.name
+	}
+	patterns := make([]string, len(r.patterns))
+	for i, p := range r.patterns {
+		patterns[i] = p.String()
+	}
+	return strings.Join(patterns, andSeparator)
+}
+
+// match reports whether the line matches all patterns of the rule
+func (r rule) match(input string) bool {
+	for _, p := range r.patterns {
+		if !p.MatchString(input) {
+			return false
+		}
+	}
+	return true
+}
+
+// lineTransform is a regex replacement from ERMON_LINE_TRANSFORM
+type lineTransform struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+type header struct {
+	name  string
+	value string
+}
+
+// headers that ermon sets itself and can't be overridden with ERMON_EXTRA_HEADERS
+var reservedHeaders = []string{"From", "To", "Subject", "Date", "Reply-To", "Content-Type", "Message-ID", "In-Reply-To", "References"}
+
+// andSeparator joins the patterns that a line must match all at once
+const andSeparator = " && "
+
+// matches timestamps like "2022-04-10 15:04:25", "[2022-04-10T15:04:25.123Z]" at the beginning of a line
+const defaultTitleStripPattern = `^[\[(]?\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}([.,]\d+)?(Z|[+-]\d{2}:?\d{2})?[\])]?\s*`
+
+// parseConfig reads the config from r, if it's not nil, and then the config files in order,
+// values from the later files override the earlier ones.
+// Environment variables are used for the values that are missing in all of them.
+func parseConfig(r io.Reader, filenames []string) (*Config, error) {
+	values := map[string]string{}
+	if r != nil {
+		if err := readConfig(r, values); err != nil {
+			return nil, fmt.Errorf("error reading config: %s", err)
+		}
+	}
+	for _, filename := range filenames {
+		if err := readConfigFile(filename, values); err != nil {
+			return nil, err
+		}
+	}
+
+	// the profile variants of the config files, e.g. .ermon.prod, override the base files
+	if profile := eitherAorB(values["ERMON_PROFILE"], os.Getenv("ERMON_PROFILE")); profile != "" {
+		found := false
+		for _, filename := range filenames {
+			if _, err := os.Stat(filename + "." + profile); err != nil {
+				continue
+			}
+			if err := readConfigFile(filename+"."+profile, values); err != nil {
+				return nil, err
+			}
+			found = true
+		}
+		if !found && len(filenames) > 0 {
+			return nil, fmt.Errorf("no config file found for ERMON_PROFILE %q, expected %s.%s", profile, filenames[0], profile)
+		}
+	}
+
+	// read environment variables after the config files
+	get := func(key string) string {
+		return eitherAorB(values[key], os.Getenv(key))
+	}
+
+	cfg := &Config{
+		SMTPHost:          get("SMTP_HOST"),
+		SMTPPort:          get("SMTP_PORT"),
+		SMTPUsername:      get("SMTP_USERNAME"),
+		SMTPPassword:      get("SMTP_PASSWORD"),
+		SendmailPath:      get("ERMON_SENDMAIL_PATH"),
+		AppName:           get("ERMON_APP_NAME"),
+		MailFrom:          get("ERMON_MAIL_FROM"),
+		MailTo:            get("ERMON_MAIL_TO"),
+		ReplyTo:           get("ERMON_REPLY_TO"),
+		AlertHeader:       get("ERMON_ALERT_HEADER"),
+		AlertFooter:       get("ERMON_ALERT_FOOTER"),
+		SlackWebhookURL:   get("SLACK_WEBHOOK_URL"),
+		DiscordWebhookURL: get("DISCORD_WEBHOOK_URL"),
+		SocketPath:        get("ERMON_SOCKET"),
+		SourceLabel:       get("ERMON_SOURCE_LABEL"),
+		MaintenanceFile:   get("ERMON_MAINTENANCE_FILE"),
+	}
+
+	if passwordFile := get("SMTP_PASSWORD_FILE"); passwordFile != "" {
+		password, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading SMTP_PASSWORD_FILE: %s", err)
+		}
+		cfg.SMTPPassword = strings.TrimRight(string(password), "\r\n")
+	}
+
+	matchPattern := get("ERMON_MATCH_PATTERN")
+	patternFile := get("ERMON_PATTERN_FILE")
+	andPattern := get("ERMON_MATCH_AND_PATTERN")
+	matchAll := get("ERMON_MATCH_ALL") == "true" || matchPattern == "*"
+	if matchPattern == "*" {
+		matchPattern = ""
+	}
+	ignorePattern := get("ERMON_IGNORE_PATTERN")
+	resetPattern := get("ERMON_RESET_PATTERN")
+	maxEmailsPerHour := get("ERMON_MAX_EMAILS_PER_HOUR")
+	maintenanceUntil := get("ERMON_MAINTENANCE_UNTIL")
+
+	// channels are enabled by default when any of their settings are present
+	cfg.EmailEnabled = channelEnabled(get("ERMON_EMAIL_ENABLED"), eitherAorB(cfg.SMTPHost, cfg.SendmailPath), cfg.MailFrom, cfg.MailTo)
+	cfg.SlackEnabled = channelEnabled(get("ERMON_SLACK_ENABLED"), cfg.SlackWebhookURL, get("ERMON_SLACK_RULE_WEBHOOKS"))
+	switch notify := get("ERMON_NOTIFY"); notify {
+	case "":
+	case "desktop":
+		cfg.DesktopNotify = true
+	default:
+		return nil, fmt.Errorf("ERMON_NOTIFY must be \"desktop\", got %q", notify)
+	}
+	cfg.WebhookURL = get("ERMON_WEBHOOK_URL")
+	if cfg.WebhookURL != "" {
+		var err error
+		if cfg.WebhookTemplate, err = parseWebhookTemplate(eitherAorB(get("ERMON_WEBHOOK_TEMPLATE"), defaultWebhookTemplate)); err != nil {
+			return nil, fmt.Errorf("error parsing ERMON_WEBHOOK_TEMPLATE: %s", err)
+		}
+	}
+	for n := 1; get("ERMON_WEBHOOK_"+strconv.Itoa(n)+"_URL") != ""; n++ {
+		prefix := "ERMON_WEBHOOK_" + strconv.Itoa(n) + "_"
+		dest := webhookDestination{url: get(prefix + "URL"), format: eitherAorB(get(prefix+"FORMAT"), "json")}
+		var err error
+		switch dest.format {
+		case "json":
+			dest.template, err = parseWebhookTemplate(defaultWebhookTemplate)
+		case "template":
+			if get(prefix+"TEMPLATE") == "" {
+				return nil, fmt.Errorf("%sFORMAT is \"template\", but %sTEMPLATE is not set", prefix, prefix)
+			}
+			if dest.template, err = parseWebhookTemplate(get(prefix + "TEMPLATE")); err != nil {
+				return nil, fmt.Errorf("error parsing %sTEMPLATE: %s", prefix, err)
+			}
+		case "slack":
+		default:
+			return nil, fmt.Errorf("%sFORMAT must be \"json\", \"slack\" or \"template\", got %q", prefix, dest.format)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if dest.headers, err = parseHeaders(get(prefix + "HEADERS")); err != nil {
+			return nil, fmt.Errorf("error parsing %sHEADERS: %s", prefix, err)
+		}
+		cfg.Webhooks = append(cfg.Webhooks, dest)
+	}
+	if brokers := get("ERMON_KAFKA_BROKERS"); brokers != "" {
+		for _, broker := range strings.Split(brokers, ",") {
+			broker = strings.TrimSpace(broker)
+			if _, _, err := net.SplitHostPort(broker); err != nil {
+				return nil, fmt.Errorf("ERMON_KAFKA_BROKERS must be a comma-separated list of host:port, got %q", broker)
+			}
+			cfg.KafkaBrokers = append(cfg.KafkaBrokers, broker)
+		}
+	}
+	cfg.KafkaTopic = get("ERMON_KAFKA_TOPIC")
+	if (len(cfg.KafkaBrokers) == 0) != (cfg.KafkaTopic == "") {
+		return nil, fmt.Errorf("ERMON_KAFKA_BROKERS and ERMON_KAFKA_TOPIC must be set together")
+	}
+	cfg.GitHubToken = get("GITHUB_TOKEN")
+	cfg.GitHubRepo = get("GITHUB_REPO")
+	cfg.GitHubLabel = eitherAorB(get("ERMON_GITHUB_LABEL"), "ermon")
+	cfg.GitHubAPIURL = eitherAorB(get("GITHUB_API_URL"), defaultGitHubAPIURL)
+	if cfg.GitHubRepo != "" && (cfg.GitHubToken == "" || strings.Count(cfg.GitHubRepo, "/") != 1) {
+		return nil, fmt.Errorf("GITHUB_REPO must look like owner/name and requires GITHUB_TOKEN")
+	}
+	cfg.DiscordEnabled = channelEnabled(get("ERMON_DISCORD_ENABLED"), cfg.DiscordWebhookURL)
+	cfg.SocketEnabled = channelEnabled(get("ERMON_SOCKET_ENABLED"), cfg.SocketPath)
+	cfg.WebhookEnabled = channelEnabled(get("ERMON_WEBHOOK_ENABLED"), cfg.WebhookURL, get("ERMON_WEBHOOK_1_URL"))
+	cfg.GitHubEnabled = channelEnabled(get("ERMON_GITHUB_ENABLED"), cfg.GitHubRepo)
+	cfg.KafkaEnabled = channelEnabled(get("ERMON_KAFKA_ENABLED"), cfg.KafkaTopic)
+	if !cfg.EmailEnabled && !cfg.SlackEnabled && !cfg.DiscordEnabled && !cfg.SocketEnabled && !cfg.DesktopNotify && !cfg.WebhookEnabled && !cfg.GitHubEnabled && !cfg.KafkaEnabled &&
+		len(customNotifiers) == 0 {
+		return nil, fmt.Errorf("no alert channels are enabled, configure email, Slack, Discord, ERMON_SOCKET, ERMON_NOTIFY, ERMON_WEBHOOK_URL, GITHUB_REPO or ERMON_KAFKA_TOPIC")
+	}
+
+	anyPattern := eitherAorB(eitherAorB(matchPattern, andPattern), patternFile)
+	if matchAll {
+		anyPattern = "*"
+	}
+	if anyPattern == "" && (get("ERMON_MATCH_MIN_LEN") != "" || get("ERMON_MATCH_MAX_LEN") != "") {
+		anyPattern = "length"
+	}
+
+	type requiredValue struct {
+		group string
+		key   string
+		value string
+	}
+
+	// required values grouped by what they are used for, in the order they are reported
+	required := []requiredValue{
+		{"general", "ERMON_APP_NAME", cfg.AppName},
+		{"general", "ERMON_MATCH_PATTERN", anyPattern},
+	}
+	if cfg.EmailEnabled {
+		required = append(required,
+			requiredValue{"email", "SMTP_HOST", eitherAorB(cfg.SMTPHost, cfg.SendmailPath)},
+			requiredValue{"email", "ERMON_MAIL_FROM", cfg.MailFrom},
+			requiredValue{"email", "ERMON_MAIL_TO", cfg.MailTo},
+		)
+	}
+	if cfg.SlackEnabled {
+		required = append(required, requiredValue{"slack", "SLACK_WEBHOOK_URL", eitherAorB(cfg.SlackWebhookURL, get("ERMON_SLACK_RULE_WEBHOOKS"))})
+	}
+	if cfg.DiscordEnabled {
+		required = append(required, requiredValue{"discord", "DISCORD_WEBHOOK_URL", cfg.DiscordWebhookURL})
+	}
+	if cfg.SocketEnabled {
+		required = append(required, requiredValue{"socket", "ERMON_SOCKET", cfg.SocketPath})
+	}
+	if cfg.WebhookEnabled {
+		required = append(required, requiredValue{"webhook", "ERMON_WEBHOOK_URL", eitherAorB(cfg.WebhookURL, get("ERMON_WEBHOOK_1_URL"))})
+	}
+	if cfg.GitHubEnabled {
+		required = append(required, requiredValue{"github", "GITHUB_REPO", cfg.GitHubRepo})
+	}
+	if cfg.KafkaEnabled {
+		required = append(required, requiredValue{"kafka", "ERMON_KAFKA_TOPIC", cfg.KafkaTopic})
+	}
+
+	// validate all fields are present and report all of the missing ones at once
+	var missing []string
+	var missingGroup []string
+	for i, r := range required {
+		if len(r.value) == 0 {
+			missingGroup = append(missingGroup, r.key)
+		}
+		if (i == len(required)-1 || required[i+1].group != r.group) && len(missingGroup) > 0 {
+			missing = append(missing, r.group+": "+strings.Join(missingGroup, ", "))
+			missingGroup = nil
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing required config values (%s)", strings.Join(missing, "; "))
+	}
+
+	if cfg.EmailEnabled && get("ERMON_VALIDATE_RECIPIENTS") == "true" {
+		for _, v := range []struct{ key, address string }{{"ERMON_MAIL_FROM", cfg.MailFrom}, {"ERMON_MAIL_TO", cfg.MailTo}} {
+			if err := validateMailDomain(v.address); err != nil {
+				return nil, fmt.Errorf("error validating %s: %s", v.key, err)
+			}
+		}
+	}
+
+	var err error
+	cfg.MaxEmailsPerHour = 5 // default
+	if maxEmailsPerHour != "" {
+		cfg.MaxEmailsPerHour, err = strconv.Atoi(maxEmailsPerHour)
+		if err != nil {
+			return cfg, fmt.Errorf("error converting ERMON_MAX_EMAILS_PER_HOUR to integer: %s", err)
+		}
+	}
+
+	if sampleHead := get("ERMON_SAMPLE_HEAD"); sampleHead != "" {
+		cfg.SampleHead, err = strconv.Atoi(sampleHead)
+		if err != nil || cfg.SampleHead < 0 {
+			return cfg, fmt.Errorf("ERMON_SAMPLE_HEAD must be a non-negative integer: %s", sampleHead)
+		}
+	}
+
+	if sampleTail := get("ERMON_SAMPLE_TAIL"); sampleTail != "" {
+		cfg.SampleTail, err = strconv.Atoi(sampleTail)
+		if err != nil || cfg.SampleTail < 0 {
+			return cfg, fmt.Errorf("ERMON_SAMPLE_TAIL must be a non-negative integer: %s", sampleTail)
+		}
+	}
+
+	if minLen := get("ERMON_MATCH_MIN_LEN"); minLen != "" {
+		cfg.MatchMinLen, err = strconv.Atoi(minLen)
+		if err != nil || cfg.MatchMinLen < 0 {
+			return cfg, fmt.Errorf("ERMON_MATCH_MIN_LEN must be a non-negative integer: %s", minLen)
+		}
+	}
+
+	if maxLen := get("ERMON_MATCH_MAX_LEN"); maxLen != "" {
+		cfg.MatchMaxLen, err = strconv.Atoi(maxLen)
+		if err != nil || cfg.MatchMaxLen < 0 {
+			return cfg, fmt.Errorf("ERMON_MATCH_MAX_LEN must be a non-negative integer: %s", maxLen)
+		}
+	}
+
+	if historyLines := get("ERMON_HISTORY_LINES"); historyLines != "" {
+		cfg.HistoryLines, err = strconv.Atoi(historyLines)
+		// the usual context already has that many lines, so a smaller history would do nothing
+		if err != nil || (cfg.HistoryLines != 0 && cfg.HistoryLines <= maxContextBuffer) {
+			return cfg, fmt.Errorf("ERMON_HISTORY_LINES must be 0 or an integer greater than %d: %s", maxContextBuffer, historyLines)
+		}
+	}
+
+	cfg.FlushThresholdLines = defaultFlushThresholdLines
+	if flushThreshold := get("ERMON_FLUSH_THRESHOLD_LINES"); flushThreshold != "" {
+		cfg.FlushThresholdLines, err = strconv.Atoi(flushThreshold)
+		// a smaller batch would be filled by the context before and after a single error
+		if err != nil || cfg.FlushThresholdLines < maxContextBuffer*2 {
+			return cfg, fmt.Errorf("ERMON_FLUSH_THRESHOLD_LINES must be an integer of at least %d: %s", maxContextBuffer*2, flushThreshold)
+		}
+	}
+
+	if matchWorkers := get("ERMON_MATCH_WORKERS"); matchWorkers != "" {
+		cfg.MatchWorkers, err = strconv.Atoi(matchWorkers)
+		if err != nil {
+			return cfg, fmt.Errorf("error converting ERMON_MATCH_WORKERS to integer: %s", err)
+		}
+	}
+
+	cfg.ConsecutiveThreshold = 1 // default
+	if threshold := get("ERMON_CONSECUTIVE_THRESHOLD"); threshold != "" {
+		cfg.ConsecutiveThreshold, err = strconv.Atoi(threshold)
+		if err != nil {
+			return cfg, fmt.Errorf("error converting ERMON_CONSECUTIVE_THRESHOLD to integer: %s", err)
+		}
+	}
+
+	cfg.ConsecutiveWindow = time.Minute * 5 // default
+	if window := get("ERMON_CONSECUTIVE_WINDOW"); window != "" {
+		cfg.ConsecutiveWindow, err = time.ParseDuration(window)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing ERMON_CONSECUTIVE_WINDOW: %s", err)
+		}
+	}
+
+	cfg.SampleRate = 1 // default
+	if sampleRate := get("ERMON_SAMPLE_RATE"); sampleRate != "" {
+		cfg.SampleRate, err = strconv.ParseFloat(sampleRate, 64)
+		if err != nil || cfg.SampleRate <= 0 || cfg.SampleRate > 1 {
+			return cfg, fmt.Errorf("ERMON_SAMPLE_RATE must be a number between 0 and 1: %s", sampleRate)
+		}
+	}
+	if rateThreshold := get("ERMON_RATE_THRESHOLD"); rateThreshold != "" {
+		cfg.RateThreshold, err = strconv.ParseFloat(rateThreshold, 64)
+		if err != nil || cfg.RateThreshold < 0 {
+			return cfg, fmt.Errorf("ERMON_RATE_THRESHOLD must be a non-negative number: %s", rateThreshold)
+		}
+	}
+
+	cfg.RateWindow = time.Minute * 5 // default
+	if window := get("ERMON_RATE_WINDOW"); window != "" {
+		cfg.RateWindow, err = time.ParseDuration(window)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing ERMON_RATE_WINDOW: %s", err)
+		}
+		if cfg.RateWindow <= 0 {
+			return cfg, fmt.Errorf("ERMON_RATE_WINDOW must be positive: %s", window)
+		}
+	}
+
+	cfg.AlertOnce = get("ERMON_ALERT_ONCE") == "true"
+	cfg.AlertOnceTimeout = time.Hour // default
+	if timeout := get("ERMON_ALERT_ONCE_TIMEOUT"); timeout != "" {
+		cfg.AlertOnceTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing ERMON_ALERT_ONCE_TIMEOUT: %s", err)
+		}
+	}
+
+	if silenceTimeout := get("ERMON_SILENCE_TIMEOUT"); silenceTimeout != "" {
+		cfg.SilenceTimeout, err = time.ParseDuration(silenceTimeout)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing ERMON_SILENCE_TIMEOUT: %s", err)
+		}
+	}
+
+	if expectRate := get("ERMON_EXPECT_RATE"); expectRate != "" {
+		cfg.ExpectRate, err = strconv.Atoi(expectRate)
+		if err != nil || cfg.ExpectRate < 1 {
+			return cfg, fmt.Errorf("ERMON_EXPECT_RATE must be a positive integer: %s", expectRate)
+		}
+	}
+
+	cfg.ExpectRateWindow = time.Minute // default
+	if expectRateWindow := get("ERMON_EXPECT_RATE_WINDOW"); expectRateWindow != "" {
+		cfg.ExpectRateWindow, err = time.ParseDuration(expectRateWindow)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing ERMON_EXPECT_RATE_WINDOW: %s", err)
+		}
+		if cfg.ExpectRateWindow <= 0 {
+			return cfg, fmt.Errorf("ERMON_EXPECT_RATE_WINDOW must be positive: %s", expectRateWindow)
+		}
+	}
+
+	if maxBufferAge := get("ERMON_MAX_BUFFER_AGE"); maxBufferAge != "" {
+		cfg.MaxBufferAge, err = time.ParseDuration(maxBufferAge)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing ERMON_MAX_BUFFER_AGE: %s", err)
+		}
+	}
+
+	cfg.ErrorWindow = defaultErrorWindow
+	if errorWindow := get("ERMON_ERROR_WINDOW"); errorWindow != "" {
+		cfg.ErrorWindow, err = time.ParseDuration(errorWindow)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing ERMON_ERROR_WINDOW: %s", err)
+		}
+		if cfg.ErrorWindow <= 0 {
+			return cfg, fmt.Errorf("ERMON_ERROR_WINDOW must be positive: %s", errorWindow)
+		}
+	}
+
+	if maxBodyBytes := get("ERMON_MAX_BODY_BYTES"); maxBodyBytes != "" {
+		size, err := parseByteSize(maxBodyBytes)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing ERMON_MAX_BODY_BYTES: %s", err)
+		}
+		cfg.MaxBodyBytes = int(size)
+		if cfg.MaxBodyBytes < minBodyBytes {
+			return cfg, fmt.Errorf("ERMON_MAX_BODY_BYTES must be at least 1KB: %s", maxBodyBytes)
+		}
+	}
+
+	if recoveryWindow := get("ERMON_RECOVERY_WINDOW"); recoveryWindow != "" {
+		cfg.RecoveryWindow, err = time.ParseDuration(recoveryWindow)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing ERMON_RECOVERY_WINDOW: %s", err)
+		}
+	}
+
+	if initialDelay := get("ERMON_INITIAL_DELAY"); initialDelay != "" {
+		cfg.InitialDelay, err = time.ParseDuration(initialDelay)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing ERMON_INITIAL_DELAY: %s", err)
+		}
+	}
+
+	if shutdownTimeout := get("ERMON_SHUTDOWN_TIMEOUT"); shutdownTimeout != "" {
+		cfg.ShutdownTimeout, err = time.ParseDuration(shutdownTimeout)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing ERMON_SHUTDOWN_TIMEOUT: %s", err)
+		}
+	}
+
+	if maxRuntime := get("ERMON_MAX_RUNTIME"); maxRuntime != "" {
+		cfg.MaxRuntime, err = time.ParseDuration(maxRuntime)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing ERMON_MAX_RUNTIME: %s", err)
+		}
+	}
+
+	cfg.BreakerFailures = 3 // default
+	if breakerFailures := get("ERMON_BREAKER_FAILURES"); breakerFailures != "" {
+		cfg.BreakerFailures, err = strconv.Atoi(breakerFailures)
+		if err != nil {
+			return cfg, fmt.Errorf("error converting ERMON_BREAKER_FAILURES to integer: %s", err)
+		}
+	}
+
+	cfg.SendConcurrency = 4 // default
+	if sendConcurrency := get("ERMON_SEND_CONCURRENCY"); sendConcurrency != "" {
+		cfg.SendConcurrency, err = strconv.Atoi(sendConcurrency)
+		if err != nil || cfg.SendConcurrency < 1 {
+			return cfg, fmt.Errorf("ERMON_SEND_CONCURRENCY must be a positive integer: %s", sendConcurrency)
+		}
+	}
+
+	cfg.EchoSample = 1 // default
+	if echo := get("ERMON_ECHO_SAMPLE"); echo != "" {
+		cfg.EchoSample, err = strconv.Atoi(echo)
+		if err != nil || cfg.EchoSample < 0 {
+			return cfg, fmt.Errorf("ERMON_ECHO_SAMPLE must be a non-negative integer: %s", echo)
+		}
+	}
+
+	cfg.Verbosity = verbosityInfo // default
+	if level := get("ERMON_VERBOSITY"); level != "" {
+		var ok bool
+		if cfg.Verbosity, ok = verbosityLevels[level]; !ok {
+			return cfg, fmt.Errorf("ERMON_VERBOSITY must be \"quiet\", \"error\" or \"info\", got %q", level)
+		}
+	}
+
+	cfg.BreakerCooldown = time.Minute * 5 // default
+	if breakerCooldown := get("ERMON_BREAKER_COOLDOWN"); breakerCooldown != "" {
+		cfg.BreakerCooldown, err = time.ParseDuration(breakerCooldown)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing ERMON_BREAKER_COOLDOWN: %s", err)
+		}
+	}
+
+	cfg.SpoolDir = get("ERMON_SPOOL_DIR")
+	if cfg.SpoolDir != "" {
+		if err := os.MkdirAll(cfg.SpoolDir, 0700); err != nil {
+			return cfg, fmt.Errorf("error creating ERMON_SPOOL_DIR: %s", err)
+		}
+	}
+
+	cfg.SpoolMax = 100 // default
+	if spoolMax := get("ERMON_SPOOL_MAX"); spoolMax != "" {
+		cfg.SpoolMax, err = strconv.Atoi(spoolMax)
+		if err != nil {
+			return cfg, fmt.Errorf("error converting ERMON_SPOOL_MAX to integer: %s", err)
+		}
+	}
+
+	cfg.StatsdAddr = get("ERMON_STATSD_ADDR")
+	cfg.StatsdPrefix = "ermon." // default
+	if prefix := get("ERMON_STATSD_PREFIX"); prefix != "" {
+		cfg.StatsdPrefix = strings.TrimSuffix(prefix, ".") + "."
+	}
+	cfg.StatsdInterval = time.Second * 10 // default
+	if statsdInterval := get("ERMON_STATSD_INTERVAL"); statsdInterval != "" {
+		cfg.StatsdInterval, err = time.ParseDuration(statsdInterval)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing ERMON_STATSD_INTERVAL: %s", err)
+		}
+		if cfg.StatsdInterval <= 0 {
+			return cfg, fmt.Errorf("ERMON_STATSD_INTERVAL must be positive: %s", statsdInterval)
+		}
+	}
+
+	cfg.HTTPAddr = get("ERMON_HTTP_ADDR")
+
+	cfg.Location = time.Local
+	if timezone := get("ERMON_TIMEZONE"); timezone != "" {
+		cfg.Location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid ERMON_TIMEZONE: %s", err)
+		}
+	}
+
+	if burstWindow := get("ERMON_BURST_WINDOW"); burstWindow != "" {
+		cfg.BurstWindow, err = time.ParseDuration(burstWindow)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing ERMON_BURST_WINDOW: %s", err)
+		}
+	}
+
+	type namedPattern struct {
+		name     string
+		patterns []string
+	}
+	var namedPatterns []namedPattern
+	if matchAll {
+		// the empty pattern matches every line
+		namedPatterns = append(namedPatterns, namedPattern{"", []string{""}})
+	}
+	if matchPattern != "" {
+		namedPatterns = append(namedPatterns, namedPattern{"", []string{matchPattern}})
+	}
+	if andPattern != "" {
+		namedPatterns = append(namedPatterns, namedPattern{"", strings.Split(andPattern, andSeparator)})
+	}
+	if patternFile != "" {
+		filePatterns, err := readPatternFile(patternFile)
+		if err != nil {
+			return cfg, err
+		}
+		for _, line := range filePatterns {
+			name, pattern := splitRuleName(line)
+			namedPatterns = append(namedPatterns, namedPattern{name, strings.Split(pattern, andSeparator)})
+		}
+	}
+
+	caseInsensitive := get("ERMON_MATCH_CASE_INSENSITIVE") == "true"
+	if caseInsensitive {
+		ignorePattern = caseInsensitivePattern(ignorePattern)
+	}
+
+	for _, p := range namedPatterns {
+		r := rule{name: p.name}
+		for _, pattern := range p.patterns {
+			pattern = strings.TrimSpace(pattern)
+			if caseInsensitive {
+				pattern = caseInsensitivePattern(pattern)
+			}
+			compiled, err := compilePattern(pattern)
+			if err != nil {
+				return cfg, fmt.Errorf("error compiling match pattern %q: %s", pattern, err)
+			}
+			r.patterns = append(r.patterns, compiled)
+		}
+		cfg.Rules = append(cfg.Rules, r)
+	}
+
+	ruleWebhooks, err := parseRuleWebhooks(get("ERMON_SLACK_RULE_WEBHOOKS"))
+	if err != nil {
+		return cfg, fmt.Errorf("error parsing ERMON_SLACK_RULE_WEBHOOKS: %s", err)
+	}
+	for name, url := range ruleWebhooks {
+		found := false
+		for i := range cfg.Rules {
+			if cfg.Rules[i].name == name {
+				cfg.Rules[i].slackWebhook = url
+				found = true
+			}
+		}
+		if !found {
+			return cfg, fmt.Errorf("error parsing ERMON_SLACK_RULE_WEBHOOKS: there is no rule named %q", name)
+		}
+	}
+
+	escalations, err := parseRuleEscalations(get("ERMON_RULE_ESCALATIONS"))
+	if err != nil {
+		return cfg, fmt.Errorf("error parsing ERMON_RULE_ESCALATIONS: %s", err)
+	}
+	for name, esc := range escalations {
+		found := false
+		for i := range cfg.Rules {
+			if cfg.Rules[i].name == name {
+				esc := esc
+				cfg.Rules[i].escalation = &esc
+				found = true
+			}
+		}
+		if !found {
+			return cfg, fmt.Errorf("error parsing ERMON_RULE_ESCALATIONS: there is no rule named %q", name)
+		}
+	}
+	if len(escalations) > 0 && cfg.WebhookTemplate == nil {
+		if cfg.WebhookTemplate, err = parseWebhookTemplate(eitherAorB(get("ERMON_WEBHOOK_TEMPLATE"), defaultWebhookTemplate)); err != nil {
+			return cfg, fmt.Errorf("error parsing ERMON_WEBHOOK_TEMPLATE: %s", err)
+		}
+	}
+
+	if ignorePattern != "" {
+		cfg.IgnorePattern, err = compilePattern(ignorePattern)
+		if err != nil {
+			return cfg, fmt.Errorf("error compiling ERMON_IGNORE_PATTERN: %s", err)
+		}
+	}
+
+	blockStart, blockEnd := get("ERMON_IGNORE_BLOCK_START"), get("ERMON_IGNORE_BLOCK_END")
+	if (blockStart == "") != (blockEnd == "") {
+		return cfg, fmt.Errorf("ERMON_IGNORE_BLOCK_START and ERMON_IGNORE_BLOCK_END must be set together")
+	}
+	if blockStart != "" {
+		if cfg.IgnoreBlockStart, err = compilePattern(blockStart); err != nil {
+			return cfg, fmt.Errorf("error compiling ERMON_IGNORE_BLOCK_START: %s", err)
+		}
+		if cfg.IgnoreBlockEnd, err = compilePattern(blockEnd); err != nil {
+			return cfg, fmt.Errorf("error compiling ERMON_IGNORE_BLOCK_END: %s", err)
+		}
+	}
+
+	if warningPattern := get("ERMON_WARNING_PATTERN"); warningPattern != "" {
+		if caseInsensitive {
+			warningPattern = caseInsensitivePattern(warningPattern)
+		}
+		cfg.WarningPattern, err = compilePattern(warningPattern)
+		if err != nil {
+			return cfg, fmt.Errorf("error compiling ERMON_WARNING_PATTERN: %s", err)
+		}
+	}
+
+	if redactPattern := get("ERMON_REDACT_PATTERN"); redactPattern != "" {
+		cfg.RedactPattern, err = compilePattern(redactPattern)
+		if err != nil {
+			return cfg, fmt.Errorf("error compiling ERMON_REDACT_PATTERN: %s", err)
+		}
+	}
+
+	successPattern := get("ERMON_SUCCESS_PATTERN")
+	if (successPattern == "") != (cfg.ExpectRate == 0) {
+		return cfg, fmt.Errorf("ERMON_SUCCESS_PATTERN and ERMON_EXPECT_RATE must be set together")
+	}
+	if successPattern != "" {
+		cfg.SuccessPattern, err = compilePattern(successPattern)
+		if err != nil {
+			return cfg, fmt.Errorf("error compiling ERMON_SUCCESS_PATTERN: %s", err)
+		}
+	}
+
+	if contextEndPattern := get("ERMON_CONTEXT_END_PATTERN"); contextEndPattern != "" {
+		cfg.ContextEndPattern, err = compilePattern(contextEndPattern)
+		if err != nil {
+			return cfg, fmt.Errorf("error compiling ERMON_CONTEXT_END_PATTERN: %s", err)
+		}
+	}
+
+	if highlightPattern := get("ERMON_HIGHLIGHT_PATTERN"); highlightPattern != "" {
+		if caseInsensitive {
+			highlightPattern = caseInsensitivePattern(highlightPattern)
+		}
+		cfg.HighlightPattern, err = compilePattern(highlightPattern)
+		if err != nil {
+			return cfg, fmt.Errorf("error compiling ERMON_HIGHLIGHT_PATTERN: %s", err)
+		}
+	}
+
+	cfg.JSONMultiline = get("ERMON_JSON_MULTILINE") == "true"
+	cfg.JSONMaxLines = defaultJSONMaxLines
+	if jsonMaxLines := get("ERMON_JSON_MAX_LINES"); jsonMaxLines != "" {
+		cfg.JSONMaxLines, err = strconv.Atoi(jsonMaxLines)
+		if err != nil || cfg.JSONMaxLines < 1 {
+			return cfg, fmt.Errorf("ERMON_JSON_MAX_LINES must be a positive integer: %s", jsonMaxLines)
+		}
+	}
+
+	if typePattern := get("ERMON_TYPE_PATTERN"); typePattern != "" {
+		cfg.TypePattern, err = compilePattern(typePattern)
+		if err != nil {
+			return cfg, fmt.Errorf("error compiling ERMON_TYPE_PATTERN: %s", err)
+		}
+		if cfg.TypePattern.NumSubexp() == 0 {
+			return cfg, fmt.Errorf("ERMON_TYPE_PATTERN must have a capture group for the error type, e.g. (\\w+(?:Exception|Error))")
+		}
+	}
+
+	if cfg.GroupBy = get("ERMON_GROUP_BY"); cfg.GroupBy != "" {
+		found := cfg.WarningPattern != nil && cfg.WarningPattern.SubexpIndex(cfg.GroupBy) >= 0
+		for _, r := range cfg.Rules {
+			for _, p := range r.patterns {
+				found = found || p.SubexpIndex(cfg.GroupBy) >= 0
+			}
+		}
+		if !found {
+			return cfg, fmt.Errorf("ERMON_GROUP_BY: none of the match patterns has a capture group named %q, e.g. (?P<%s>\\S+)", cfg.GroupBy, cfg.GroupBy)
+		}
+	}
+
+	if threadPattern := get("ERMON_THREAD_PATTERN"); threadPattern != "" {
+		cfg.ThreadPattern, err = compilePattern(threadPattern)
+		if err != nil {
+			return cfg, fmt.Errorf("error compiling ERMON_THREAD_PATTERN: %s", err)
+		}
+		if cfg.ThreadPattern.NumSubexp() == 0 {
+			return cfg, fmt.Errorf("ERMON_THREAD_PATTERN must have a capture group for the thread ID")
+		}
+	}
+
+	if resetPattern != "" {
+		cfg.ResetPattern, err = compilePattern(resetPattern)
+		if err != nil {
+			return cfg, fmt.Errorf("error compiling ERMON_RESET_PATTERN: %s", err)
+		}
+	}
+
+	cfg.ShowSource = get("ERMON_SHOW_SOURCE") != "false"
+	cfg.MaintenanceSummary = get("ERMON_MAINTENANCE_SUMMARY") == "true"
+	cfg.ShowLineNumbers = get("ERMON_SHOW_LINE_NUMBERS") == "true"
+	cfg.ShowIgnoredCount = get("ERMON_SHOW_IGNORED_COUNT") == "true"
+	cfg.StripANSI = get("ERMON_STRIP_ANSI") == "true"
+	if cfg.LineTransforms, err = parseLineTransforms(get("ERMON_LINE_TRANSFORM")); err != nil {
+		return cfg, fmt.Errorf("error parsing ERMON_LINE_TRANSFORM: %s", err)
+	}
+	cfg.StoreTransformed = get("ERMON_LINE_TRANSFORM_STORE") == "true"
+	cfg.KeepBlankLines = get("ERMON_KEEP_BLANK_LINES") == "true"
+	cfg.Plaintext = get("ERMON_PLAINTEXT") == "true"
+	cfg.SendOnExit = get("ERMON_SEND_ON_EXIT") != "false"
+	cfg.CrashGrace = eitherAorB(get("ERMON_CRASH_GRACE"), "always")
+	if cfg.CrashGrace != "always" && cfg.CrashGrace != "crash" && cfg.CrashGrace != "off" {
+		return cfg, fmt.Errorf("ERMON_CRASH_GRACE must be \"always\", \"crash\" or \"off\", got %q", cfg.CrashGrace)
+	}
+	cfg.ShowTrigger = get("ERMON_SHOW_TRIGGER") == "true"
+	cfg.SubjectDelta = get("ERMON_SUBJECT_DELTA") == "true"
+	cfg.AlertDelta = get("ERMON_ALERT_DELTA") == "true"
+	cfg.EmailThreading = get("ERMON_EMAIL_THREADING") == "true"
+	cfg.Profile = get("ERMON_PROFILE")
+	cfg.LineSplit = get("ERMON_LINE_SPLIT")
+	if cfg.LineSplit != "" && cfg.LineSplit != "newline" && cfg.LineSplit != "cr" && cfg.LineSplit != "crlf" {
+		return cfg, fmt.Errorf("ERMON_LINE_SPLIT must be \"newline\", \"cr\" or \"crlf\", got %q", cfg.LineSplit)
+	}
+	cfg.MatchStream = get("ERMON_MATCH_STREAM")
+	if cfg.MatchStream != "" && cfg.MatchStream != "stdout" && cfg.MatchStream != "stderr" {
+		return cfg, fmt.Errorf("ERMON_MATCH_STREAM must be \"stdout\" or \"stderr\", got %q", cfg.MatchStream)
+	}
+	cfg.SeverityPrefix = get("ERMON_SEVERITY_PREFIX")
+	if _, ok := severityPrefixes[cfg.SeverityPrefix]; !ok && cfg.SeverityPrefix != "" {
+		return cfg, fmt.Errorf("ERMON_SEVERITY_PREFIX must be \"emoji\" or \"text\", got %q", cfg.SeverityPrefix)
+	}
+	cfg.FoldDuplicates = get("ERMON_FOLD_DUPLICATES") == "true"
+	cfg.SummaryOnly = get("ERMON_SUMMARY_ONLY") == "true"
+	cfg.FailOnAlert = get("ERMON_FAIL_ON_ALERT") == "true"
+	cfg.SanitizeUTF8 = get("ERMON_SANITIZE_UTF8") == "true"
+
+	cfg.SubjectTitle = get("ERMON_SUBJECT_TITLE") == "true"
+	cfg.TitleStripPattern, err = compilePattern(eitherAorB(get("ERMON_TITLE_STRIP_PATTERN"), defaultTitleStripPattern))
+	if err != nil {
+		return cfg, fmt.Errorf("error compiling ERMON_TITLE_STRIP_PATTERN: %s", err)
+	}
+
+	if strings.ContainsAny(cfg.ReplyTo, "\r\n") {
+		return cfg, fmt.Errorf("ERMON_REPLY_TO must not contain line breaks")
+	}
+
+	cfg.ExtraHeaders, err = parseHeaders(get("ERMON_EXTRA_HEADERS"))
+	if err != nil {
+		return cfg, fmt.Errorf("error parsing ERMON_EXTRA_HEADERS: %s", err)
+	}
+
+	switch overflow := get("ERMON_OVERFLOW"); overflow {
+	case "", "drop":
+	case "block":
+		cfg.BlockOnOverflow = true
+	default:
+		return cfg, fmt.Errorf("invalid ERMON_OVERFLOW value: %s (expected drop or block)", overflow)
+	}
+
+	if maintenanceUntil != "" {
+		cfg.MaintenanceUntil, err = time.Parse(time.RFC3339, maintenanceUntil)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing ERMON_MAINTENANCE_UNTIL: %s", err)
+		}
+	}
+
+	for _, path := range strings.Split(get("ERMON_LOG_FILES"), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			cfg.LogFiles = append(cfg.LogFiles, path)
+		}
+	}
+	cfg.JournalUnit = get("ERMON_JOURNAL_UNIT")
+
+	return cfg, nil
+}
+
+// parseLineTransforms parses sed-like replacements, e.g. "s/^pod-[a-z0-9-]+ //; s|user=\S+|user=***|".
+// The character after s is the delimiter, it can be escaped with a backslash in the pattern and the replacement.
+func parseLineTransforms(input string) ([]lineTransform, error) {
+	var transforms []lineTransform
+	rest := strings.TrimSpace(input)
+	for rest != "" {
+		if len(rest) < 2 || rest[0] != 's' {
+			return nil, fmt.Errorf("expected s/pattern/replacement/, got %q", rest)
+		}
+		delimiter := rest[1]
+		var parts []string
+		var part strings.Builder
+		i := 2
+		for ; i < len(rest) && len(parts) < 2; i++ {
+			switch {
+			case rest[i] == '\\' && i+1 < len(rest) && rest[i+1] == delimiter:
+				part.WriteByte(delimiter)
+				i++
+			case rest[i] == delimiter:
+				parts = append(parts, part.String())
+				part.Reset()
+			default:
+				part.WriteByte(rest[i])
+			}
+		}
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("missing the closing %c in %q", delimiter, rest)
+		}
+		pattern, err := compilePattern(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		transforms = append(transforms, lineTransform{pattern: pattern, replacement: parts[1]})
+		rest = strings.TrimLeft(rest[i:], "; ")
+	}
+	return transforms, nil
+}
+
+// parseRuleWebhooks parses "rule name=url" pairs separated by semicolons
+func parseRuleWebhooks(input string) (map[string]string, error) {
+	webhooks := map[string]string{}
+	for _, pair := range strings.Split(input, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("expected rule name=url, got %q", pair)
+		}
+		webhooks[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return webhooks, nil
+}
+
+// parseByteSize parses a number of bytes with an optional unit, e.g. 512KB or 1MB. The units are B, KB, MB and GB,
+// in powers of 1024 and case-insensitive.
+func parseByteSize(input string) (int64, error) {
+	text := strings.ToUpper(strings.TrimSpace(input))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(text, unit.suffix) {
+			text = strings.TrimSpace(strings.TrimSuffix(text, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("expected a size like 512KB or 1MB, got %q", input)
+	}
+	if n > math.MaxInt32/multiplier {
+		return 0, fmt.Errorf("%q is too large", input)
+	}
+	return n * multiplier, nil
+}
+
+// parseRuleEscalations parses "rule name=count/window=url" pairs separated by semicolons, e.g. "Payments=10/5m=https://..."
+func parseRuleEscalations(input string) (map[string]escalation, error) {
+	escalations := map[string]escalation{}
+	for _, entry := range strings.Split(input, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 3)
+		if len(parts) != 3 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[2]) == "" {
+			return nil, fmt.Errorf("expected rule name=count/window=url, got %q", entry)
+		}
+		rate := strings.SplitN(strings.TrimSpace(parts[1]), "/", 2)
+		if len(rate) != 2 {
+			return nil, fmt.Errorf("expected the rate as count/window, e.g. 10/5m, got %q", parts[1])
+		}
+		threshold, err := strconv.Atoi(rate[0])
+		if err != nil || threshold < 0 {
+			return nil, fmt.Errorf("the count must be a non-negative integer: %s", rate[0])
+		}
+		window, err := time.ParseDuration(rate[1])
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("the window must be a positive Go duration: %s", rate[1])
+		}
+		escalations[strings.TrimSpace(parts[0])] = escalation{threshold: threshold, window: window, url: strings.TrimSpace(parts[2])}
+	}
+	return escalations, nil
+}
+
+// validateMailDomain checks that the address is valid and its domain can receive email,
+// i.e. it has MX records or, as a fallback mail servers use, an address
+func validateMailDomain(address string) error {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return err
+	}
+	domain := parsed.Address[strings.LastIndex(parsed.Address, "@")+1:]
+	if mx, err := net.LookupMX(domain); err == nil && len(mx) > 0 {
+		return nil
+	}
+	if _, err := net.LookupHost(domain); err != nil {
+		return fmt.Errorf("domain %s doesn't resolve: %s", domain, err)
+	}
+	return nil
+}
+
+// channelEnabled returns the value of the enabled flag if it's set,
+// otherwise the channel is enabled when any of its values are present
+func channelEnabled(flag string, values ...string) bool {
+	if flag != "" {
+		return flag == "true"
+	}
+	for _, v := range values {
+		if v != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// readConfigFile reads KEY=value lines from the file into values
+func readConfigFile(filename string, values map[string]string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("error opening config file: %s", err)
+	}
+	defer file.Close()
+	if err := readConfig(file, values); err != nil {
+		return fmt.Errorf("error reading config file %s: %s", filename, err)
+	}
+	return nil
+}
+
+// readConfig reads the KEY=value lines, skipping empty lines and comments.
+// Any other line is an error, it's most likely a typo that would silently drop a value.
+func readConfig(r io.Reader, values map[string]string) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if trimmed := strings.TrimSpace(line); len(trimmed) == 0 || trimmed[0] == '#' {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("line %d: expected KEY=value, got %q", n, line)
+		}
+
+		if value := strings.TrimSpace(parts[1]); value != "" {
+			values[strings.TrimSpace(parts[0])] = value
+		}
+	}
+
+	return scanner.Err()
+}
+
+// readPatternFile reads one pattern per line, skipping empty lines and comments
+func readPatternFile(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening pattern file: %s", err)
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	return patterns, scanner.Err()
+}
+
+// splitRuleName splits "Database Timeout<tab>(?i)timeout" into the name and the pattern.
+// Ordinary patterns don't have a tab, so lines like "ERROR|FATAL" are left as is.
+func splitRuleName(line string) (name string, pattern string) {
+	if name, pattern, found := strings.Cut(line, "\t"); found {
+		return strings.TrimSpace(name), strings.TrimSpace(pattern)
+	}
+	return "", line
+}
+
+// parseHeaders parses "Name: value; Other-Name: value" into a list of headers
+func parseHeaders(input string) ([]header, error) {
+	var headers []header
+	for _, pair := range strings.Split(input, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected Name: value, got %q", pair)
+		}
+
+		h := header{name: strings.TrimSpace(parts[0]), value: strings.TrimSpace(parts[1])}
+		if !validHeaderName(h.name) {
+			return nil, fmt.Errorf("invalid header name %q", h.name)
+		}
+		for _, reserved := range reservedHeaders {
+			if strings.EqualFold(h.name, reserved) {
+				return nil, fmt.Errorf("header %s can't be overridden", h.name)
+			}
+		}
+		if strings.ContainsAny(h.value, "\r\n") {
+			return nil, fmt.Errorf("value of header %s must not contain line breaks", h.name)
+		}
+		headers = append(headers, h)
+	}
+	return headers, nil
+}
+
+// validHeaderName checks the name consists of printable ASCII characters except colon (RFC 5322)
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c < 33 || c > 126 || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// caseInsensitivePattern adds the (?i) flag to the pattern unless it's already there
+func caseInsensitivePattern(pattern string) string {
+	if pattern == "" || strings.HasPrefix(pattern, "(?i)") {
+		return pattern
+	}
+	return "(?i)" + pattern
+}
+
+func eitherAorB(a, b string) string {
+	if a != "" {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPatternFileNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "patterns")
+	patterns := "# one regex per line\nERROR|FATAL\nDatabase Timeout\t(?i)timeout\nPayment Errors\tERROR && payment\n"
+	if err := os.WriteFile(path, []byte(patterns), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t, &fakeNotifier{}, "ERMON_PATTERN_FILE="+path+"\n")
+
+	tests := []struct {
+		line string
+		rule string
+	}{
+		{"ERROR db down", ""},
+		{"FATAL out of memory", ""},
+		{"query TIMEOUT after 30s", "Database Timeout"},
+	}
+	for _, test := range tests {
+		severity, rule, _, _ := matchLine(cfg, test.line)
+		if severity == severityNone || rule != test.rule {
+			t.Errorf("%q matched the rule %q with severity %d, want the rule %q", test.line, rule, severity, test.rule)
+		}
+	}
+	if len(cfg.Rules) != 3 || cfg.Rules[2].name != "Payment Errors" || len(cfg.Rules[2].patterns) != 2 {
+		t.Errorf("the named && pattern isn't parsed: %+v", cfg.Rules)
+	}
+	if severity, _, _, _ := matchLine(cfg, "INFO all good"); severity != severityNone {
+		t.Error("INFO all good is matched")
+	}
+}
+
+func TestLineLimits(t *testing.T) {
+	tests := []struct {
+		setting string
+		valid   bool
+	}{
+		{"ERMON_FLUSH_THRESHOLD_LINES=15", false},
+		{"ERMON_FLUSH_THRESHOLD_LINES=16", true},
+		{"ERMON_FLUSH_THRESHOLD_LINES=24", true},
+		{"ERMON_FLUSH_THRESHOLD_LINES=x", false},
+		{"ERMON_HISTORY_LINES=0", true},
+		{"ERMON_HISTORY_LINES=1", false},
+		{"ERMON_HISTORY_LINES=8", false},
+		{"ERMON_HISTORY_LINES=9", true},
+		{"ERMON_HISTORY_LINES=-1", false},
+	}
+	for _, test := range tests {
+		resetState()
+		customNotifiers = []registeredNotifier{{name: "fake", notifier: &fakeNotifier{}}}
+		_, err := parseConfig(strings.NewReader("ERMON_APP_NAME=test\nERMON_MATCH_PATTERN=ERROR\n"+test.setting+"\n"), nil)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got %v", test.setting, err)
+		}
+	}
+}
+
+func TestChannelEnabledFlags(t *testing.T) {
+	cfg := testConfig(t, &fakeNotifier{}, "ERMON_MATCH_PATTERN=ERROR\nDISCORD_WEBHOOK_URL=http://discord.invalid/\nERMON_SOCKET=/tmp/ermon.sock\n"+
+		"ERMON_WEBHOOK_URL=http://hook.invalid/\nERMON_WEBHOOK_1_URL=http://hook1.invalid/\nERMON_DISCORD_ENABLED=false\nERMON_WEBHOOK_ENABLED=false\n")
+	enabled := map[string]bool{}
+	for _, c := range alertChannels(cfg) {
+		enabled[c.name] = c.enabled
+	}
+	want := map[string]bool{"Discord": false, "socket": true, "webhook": false, "webhook 1": false, "GitHub": false, "fake": true}
+	for name, on := range want {
+		if enabled[name] != on {
+			t.Errorf("the %s channel is enabled: %t, want %t", name, enabled[name], on)
+		}
+	}
+
+	resetState()
+	customNotifiers = []registeredNotifier{{name: "fake", notifier: &fakeNotifier{}}}
+	_, err := parseConfig(strings.NewReader("ERMON_APP_NAME=test\nERMON_MATCH_PATTERN=ERROR\nERMON_KAFKA_ENABLED=true\n"), nil)
+	if err == nil || !strings.Contains(err.Error(), "kafka: ERMON_KAFKA_TOPIC") {
+		t.Errorf("an enabled channel without its settings is accepted: %v", err)
+	}
+}
+
+func TestExtraHeaders(t *testing.T) {
+	headers, err := parseHeaders("X-Team: payments; X-Priority: 1")
+	if err != nil || len(headers) != 2 || headers[0].name != "X-Team" || headers[1].value != "1" {
+		t.Errorf("got %+v, %v", headers, err)
+	}
+	// ermon writes these itself, a second one would make the message invalid
+	for _, input := range []string{"Subject: hi", "date: Mon, 1 Jan 2024 12:00:00 +0000", "Message-ID: <x@y>", "X-Bad: a\nb", "no colon"} {
+		if _, err := parseHeaders(input); err == nil {
+			t.Errorf("%q is accepted", input)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// demoConfig is a minimal configuration, the demo fills in the address of its fake SMTP server
+const demoConfig = `ERMON_APP_NAME=demo
+SMTP_HOST=%s
+SMTP_PORT=%s
+ERMON_MAIL_FROM=ermon@demo.localhost
+ERMON_MAIL_TO=you@demo.localhost
+ERMON_MATCH_PATTERN=ERROR|Exception
+ERMON_IGNORE_PATTERN=ERROR 404
+`
+
+// demoLogs are the lines fed to the pipeline in the demo, with a couple of seeded errors
+var demoLogs = []string{
+	"2024-05-01 12:00:00 INFO  Starting order service on :8080",
+	"2024-05-01 12:00:01 INFO  Connected to the database",
+	"2024-05-01 12:00:05 INFO  GET /orders/42 200 12ms",
+	"2024-05-01 12:00:06 WARN  GET /favicon.ico ERROR 404",
+	"2024-05-01 12:00:07 INFO  POST /orders 201 48ms",
+	"2024-05-01 12:00:09 ERROR Failed to charge the card of order 43",
+	"java.lang.IllegalStateException: payment gateway timed out",
+	"    at com.example.PaymentClient.charge(PaymentClient.java:87)",
+	"    at com.example.OrderService.checkout(OrderService.java:142)",
+	"2024-05-01 12:00:10 INFO  GET /orders/43 200 9ms",
+	"2024-05-01 12:00:12 INFO  GET /health 200 1ms",
+}
+
+// mailServer receives the emails sent by ermon, the demo uses fakeSMTPServer
+type mailServer interface {
+	Addr() string
+	Messages() <-chan string
+	Close() error
+}
+
+// fakeSMTPServer accepts any email on a local port and keeps it instead of delivering it
+type fakeSMTPServer struct {
+	listener net.Listener
+	messages chan string
+}
+
+func startFakeSMTPServer() (*fakeSMTPServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &fakeSMTPServer{listener: listener, messages: make(chan string, maxEmailBufferSize)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, nil
+}
+
+func (s *fakeSMTPServer) Addr() string            { return s.listener.Addr().String() }
+func (s *fakeSMTPServer) Messages() <-chan string { return s.messages }
+func (s *fakeSMTPServer) Close() error            { return s.listener.Close() }
+
+// serve speaks just enough SMTP for net/smtp, without TLS and authentication
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 ermon demo")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		switch command := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); command {
+		case "EHLO", "HELO":
+			text.PrintfLine("250 ermon demo")
+		case "DATA":
+			text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			message, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.messages <- string(message)
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
+// runDemo runs the whole pipeline on demoLogs and prints the email that would be delivered, it returns the exit code
+func runDemo() int {
+	server, err := startFakeSMTPServer()
+	if err != nil {
+		fmt.Println("[ermon] Error starting the fake SMTP server:", err)
+		return 1
+	}
+	defer server.Close()
+	return demo(server)
+}
+
+func demo(server mailServer) int {
+	host, port, _ := net.SplitHostPort(server.Addr())
+	body := fmt.Sprintf(demoConfig, host, port)
+	cfg, err := parseConfig(strings.NewReader(body), nil)
+	if err != nil {
+		fmt.Println("[ermon] Error parsing the demo config:", err)
+		return 1
+	}
+	// the environment variables are still read, but the demo only sends to its own server
+	cfg.disableChannels()
+	cfg.EmailEnabled = true
+	cfg.SpoolDir, cfg.StatsdAddr = "", ""
+	// the alert is sent right away, even though ermon didn't run for a minute
+	debug = true
+
+	fmt.Println("[ermon] Config:")
+	fmt.Print(body)
+	fmt.Println("[ermon] Logs:")
+	lines := make(chan LogLine, len(demoLogs))
+	for _, text := range demoLogs {
+		fmt.Println(text)
+		lines <- LogLine{Text: text, Time: now(), Source: "demo"}
+	}
+	close(lines)
+
+	sent := make(chan struct{})
+	go sendEmails(*cfg, sent)
+	runPipeline(*cfg, lines)
+	close(outbox)
+	<-sent
+
+	select {
+	case message := <-server.Messages():
+		fmt.Println("[ermon] Email received by the fake SMTP server at " + server.Addr() + ":")
+		fmt.Println(strings.TrimSpace(message))
+		return 0
+	default:
+		fmt.Println("[ermon] The fake SMTP server didn't receive any email")
+		return 1
+	}
+}
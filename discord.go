@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"strconv"
+)
+
+const discordErrorColor = 0xd50200
+const discordWarningColor = 0xde9e31
+const discordRecoveredColor = 0x2eb67d
+const maxDiscordTitleLength = 256        // Discord's limit for embed titles
+const maxDiscordDescriptionLength = 4096 // Discord's limit for embed descriptions, unlike 2000 for the content
+
+// sendDiscord posts the alert to DISCORD_WEBHOOK_URL as an embed, colored by the highest severity of the matched lines
+func sendDiscord(ctx context.Context, cfg Config, e email) error {
+	color := discordErrorColor
+	if e.severity == severityWarning {
+		color = discordWarningColor
+	} else if e.recovered {
+		color = discordRecoveredColor
+	}
+
+	title := cfg.AppName + " reported " + strconv.Itoa(e.errorCount) + " error(s)"
+	if e.test || e.crash || e.recovered {
+		title = cfg.AppName + ": " + e.title
+	}
+
+	return postJSON(ctx, cfg.DiscordWebhookURL, map[string]interface{}{
+		"embeds": []interface{}{
+			map[string]interface{}{
+				"title":       truncateText(title, maxDiscordTitleLength),
+				"description": renderMarkdown(e, commonMarkdown, maxDiscordDescriptionLength),
+				"color":       color,
+				"timestamp":   e.time.Format("2006-01-02T15:04:05Z07:00"),
+				"footer":      map[string]interface{}{"text": "Alert " + e.id},
+			},
+		},
+	})
+}
@@ -2,214 +2,1946 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"html"
 	"io"
+	"mime"
+	"net/mail"
 	"net/smtp"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
-var sendLogsMutex = &sync.Mutex{} // needed for concurrent access to the emailBuffer
-var startupTime = time.Now()      // uses this time so we don't send emails if the app crashes while running for less than 1 minute
-const runningTimeWindow = time.Minute * 2
+// now is the clock of the buffering and sending logic, it can be replaced to control the time, e.g. when replaying logs.
+// The timers and tickers that drive the pipeline still use the real time.
+var now = time.Now
+
+var startupTime = now()   // uses this time so we don't send emails if the app crashes while running for less than 1 minute
+const exitCodeAlerted = 3 // with ERMON_FAIL_ON_ALERT, when at least one alert was sent
+const defaultErrorWindow = time.Minute * 2
 const maxEmailBufferSize = 5
 const maxContextBuffer = 8
+const defaultFlushThresholdLines = maxContextBuffer * 3
+const followPollInterval = time.Millisecond * 500
+const lineQueueSize = 1000
+const maxLineLength = 64 * 1024 // longer lines are split, it's less than the limit of bufio.Scanner
+const maxTitleLength = 80
+const minBodyBytes = 1024 // bytes of the log lines that are sent even if ERMON_MAX_BODY_BYTES is smaller than the template
 
 var version = "X.Y.Z"
 var debug = os.Getenv("ERMON_DEBUG") == "true"
 var emailsSent []time.Time
 var finalRun bool = false
+var inputFailed bool // the command exited with an error or the input couldn't be read, set before the lines are closed
 var timeSinceError time.Time
-var emailBuffer [][]string
-var logBuffer []string
+var emailBuffer [][]LogLine
+var logBuffer []LogLine
 var lastErrorLineIndex uint64 = 0
+var lineNumber uint64 = 0
+var maintenanceActive bool = false
+var suppressedErrorCount = 0
+var consecutiveErrors = 0
+var consecutiveStart time.Time
+var consecutiveThresholdReached bool = false
+var errorTimes []time.Time   // times of the errors within ERMON_RATE_WINDOW
+var successTimes []time.Time // times of the lines matching ERMON_SUCCESS_PATTERN within ERMON_EXPECT_RATE_WINDOW
+var lowRateReported bool
+var rateThresholdReached bool = false
+var incidentAlerted bool = false      // with ERMON_ALERT_ONCE, an alert was sent and the incident isn't over yet
+var incidentThread string             // with ERMON_EMAIL_THREADING, ID of the first alert of the incident that the next ones reply to
+var incidentLastCount int             // error count of the previous alert of the incident, see ERMON_SUBJECT_DELTA
+var incidentSentLines map[uint64]bool // positions of the lines of the previous alert of the incident, see ERMON_ALERT_DELTA
+var lastErrorAt time.Time
+
+// sendContext is passed to the notifiers, it's canceled once ERMON_SHUTDOWN_TIMEOUT is over
+var sendContext, cancelSending = context.WithCancel(context.Background())
+var recoveryPendingSince time.Time // with ERMON_RECOVERY_WINDOW, when the alert that awaits a recovery notice was sent
+var burstStart time.Time           // time of the first error in the logBuffer
+var ignoredSinceLastEmail = 0
+var inIgnoredBlock bool             // between ERMON_IGNORE_BLOCK_START and ERMON_IGNORE_BLOCK_END
+var sampledOutSinceLastEmail = 0    // matched lines left out by ERMON_SAMPLE_RATE
+var sampleCounts = map[string]int{} // number of matched lines per trigger, for ERMON_SAMPLE_RATE
+
+// matches ANSI escape sequences, such as colors (CSI) and terminal titles (OSC)
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)`)
+
+// stats are counted since ermon started
+var stats struct {
+	lines   uint64 // non-empty lines that were processed
+	errors  uint64 // lines recognized as errors
+	ignored uint64 // lines that matched the pattern, but were excluded by the ignore pattern
+	alerts  uint64 // alerts passed on to the channels
+}
+var runningContextBuffer [maxContextBuffer]LogLine
+var highlightBuffer []LogLine // highlighted lines that fell out of runningContextBuffer
+var historyBuffer []LogLine   // last ERMON_HISTORY_LINES lines, used as the context of errors instead of runningContextBuffer
+var historyInLogBuffer int    // number of history lines in logBuffer, they don't count towards its limit
+var lastThread string         // thread ID of the last line that had one
+var batchThread string        // thread ID of the first error of the batch, the context is limited to this thread
+
+// the pipeline goroutine owns all of the buffers above, other goroutines talk to it through channels
+var flushRequests = make(chan struct{}, 1)
+var stateRequests = make(chan struct{}, 1)
+var crashMutex sync.Mutex
+var shutdown = make(chan struct{}) // closed to stop the pipeline before the input ends
+var outbox = make(chan email, maxEmailBufferSize)
+var sending *email // the alert sendEmails is sending right now
+var sendingMutex sync.Mutex
+
+// LogLine is a single line of the input along with its metadata
+type LogLine struct {
+	Text        string
+	Time        time.Time
+	Source      string // name of the input, e.g. file name
+	Matched     bool   // whether the line was recognized as an error
+	Number      uint64 // line number in its source, e.g. the file
+	Severity    int    // severity of the matched line, see severityWarning and severityError
+	Rule        string // name of the matched rule
+	Trigger     string // the rule name or the pattern that matched the line
+	Group       string // value of the ERMON_GROUP_BY capture group
+	Type        string // error type captured by ERMON_TYPE_PATTERN
+	Highlighted bool   // whether the line matches ERMON_HIGHLIGHT_PATTERN
+	Thread      string // thread ID captured by ERMON_THREAD_PATTERN
+	Stream      string // "stdout" or "stderr" when running a command
+
+	seq   uint64     // position of the line in the pipeline, tells apart the lines of all the sources
+	match *lineMatch // set once the line is matched against the patterns
+}
+
+// lineMatch is the result of matching a line against the patterns
+type lineMatch struct {
+	severity int
+	rule     string
+	trigger  string
+	group    string
+	errType  string
+	ignored  bool
+}
+
+const (
+	severityNone = iota
+	severityWarning
+	severityError
+)
+
+// severityPrefixes are the subject prefixes for ERMON_SEVERITY_PREFIX, by severity
+var severityPrefixes = map[string]map[int]string{
+	"emoji": {severityError: "🔴", severityWarning: "🟡"},
+	"text":  {severityError: "[CRIT]", severityWarning: "[WARN]"},
+}
+
+// email is a composed alert waiting to be sent
+type email struct {
+	id         string // unique ID to correlate the alert with tickets and logs
+	thread     string // ID of the first alert of the incident, if this one is a follow-up
+	errors     string
+	errorCount int
+	// previousCount is the error count of the previous alert of the same incident, 0 for the first one
+	previousCount int
+	title         string // first error line, used in the subject
+	time          time.Time
+	test          bool     // sent with --send-test
+	crash         bool     // ermon itself crashed
+	recovered     bool     // no errors for ERMON_RECOVERY_WINDOW after an alert
+	escalations   []string // rules that matched more lines than their ERMON_RULE_ESCALATIONS threshold
+	text          string   // plain text version of errors
+	severity      int      // highest severity of the lines
+	rules         []string // names of the matched rules
+	triggers      []string // rule names or patterns that matched, see ERMON_SHOW_TRIGGER
+	batches       []alertBatch
+	notes         []string // remarks after the batches, e.g. the number of ignored lines
+	summary       string   // shown before the batches, e.g. the errors by ERMON_TYPE_PATTERN
+}
+
+// alertBatch is the plain text of a single batch of the alert along with its metadata,
+// so the alert can be split between destinations
+type alertBatch struct {
+	text       string
+	title      string // the first error line, see alertTitle
+	errorCount int
+	severity   int
+	rules      []string
+}
+
+// sendLogsByEmail sends the buffered logs once enough time has passed since the last error.
+// force sends whatever is buffered right away, but still respects the rate limit.
+func sendLogsByEmail(cfg Config, force bool) {
+	// nothing is sent during the initial quiet period, the logs keep being buffered
+	if !force && now().Sub(startupTime) < cfg.InitialDelay {
+		return
+	}
+
+	// filter emailsSent to only include those within the last hour
+	var newEmailsSent []time.Time
+	for _, t := range emailsSent {
+		if now().Sub(t) < time.Hour {
+			newEmailsSent = append(newEmailsSent, t)
+		}
+	}
+	emailsSent = newEmailsSent
+
+	if len(emailsSent) >= cfg.MaxEmailsPerHour {
+		emailBuffer = nil
+		return
+	}
+
+	// with ERMON_MAX_BUFFER_AGE, sparse errors are sent even if the errors keep coming or the burst isn't over
+	bufferTooOld := cfg.MaxBufferAge > 0 && !burstStart.IsZero() && now().Sub(burstStart) >= cfg.MaxBufferAge
+	if len(logBuffer) > 0 && (finalRun || force || bufferTooOld || (!timeSinceError.IsZero() && now().Sub(timeSinceError) > cfg.ErrorWindow && !inBurst(cfg, now()))) {
+		emailBuffer = append(emailBuffer, logBuffer)
+		logBuffer = nil
+	}
+
+	if inMaintenance(cfg) {
+		// count the errors, but don't send anything
+		for _, buf := range emailBuffer {
+			for _, line := range buf {
+				if line.Matched {
+					suppressedErrorCount++
+				}
+			}
+		}
+		emailBuffer = nil
+		maintenanceActive = true
+		return
+	}
+
+	if cfg.ConsecutiveThreshold > 1 && !consecutiveThresholdReached && len(emailBuffer) > 0 {
+		if consecutiveErrors > 0 && now().Sub(consecutiveStart) < cfg.ConsecutiveWindow && !finalRun {
+			// the errors may still add up to the threshold
+			return
+		}
+		// the errors didn't last long enough to alert about them
+		emailBuffer = nil
+		return
+	}
+
+	if cfg.RateThreshold > 0 && !rateThresholdReached && len(emailBuffer) > 0 {
+		if len(errorTimes) > 0 && now().Sub(errorTimes[0]) < cfg.RateWindow && !finalRun {
+			// the rate may still exceed the threshold
+			return
+		}
+		// isolated errors, the error budget wasn't breached
+		emailBuffer = nil
+		return
+	}
+
+	maintenanceSummary := ""
+	suppressedCount := 0
+	if maintenanceActive {
+		// maintenance is over
+		if cfg.MaintenanceSummary && suppressedErrorCount > 0 {
+			suppressedCount = suppressedErrorCount
+			maintenanceSummary = strconv.Itoa(suppressedCount) + " error(s) were suppressed during maintenance"
+		}
+		maintenanceActive = false
+		suppressedErrorCount = 0
+	}
+
+	// don't send email if the app has been running for less than 1 minute and then crashed
+	if finalRun && !force && now().Sub(startupTime) < time.Minute && !debug && crashGrace(cfg) {
+		return
+	}
+
+	if cfg.AlertOnce && incidentAlerted && maintenanceSummary == "" {
+		// the incident was already reported
+		emailBuffer = nil
+		return
+	}
+
+	// save the last email of the hour for errors, the warnings wait until then or until the limit is over,
+	// leaving room in the buffer for a batch with errors
+	if len(emailsSent) == cfg.MaxEmailsPerHour-1 && cfg.MaxEmailsPerHour > 1 && len(emailBuffer) > 0 && maintenanceSummary == "" && !finalRun {
+		highest := severityNone
+		for _, buf := range emailBuffer {
+			highest = max(highest, batchSeverity(buf))
+		}
+		if highest < severityError {
+			// with ERMON_OVERFLOW=block, the pipeline waits for room instead
+			if len(emailBuffer) >= maxEmailBufferSize && !cfg.BlockOnOverflow {
+				dropped := len(emailBuffer) - maxEmailBufferSize + 1
+				emailBuffer = emailBuffer[dropped:]
+				logInfo(fmt.Sprintf("Dropped the %d oldest warning batch(es), the last email of the hour is saved for errors", dropped))
+			}
+			return
+		}
+	}
+
+	// the most severe batches go first
+	sort.SliceStable(emailBuffer, func(i, j int) bool {
+		return batchSeverity(emailBuffer[i]) > batchSeverity(emailBuffer[j])
+	})
+
+	if len(emailBuffer) == 0 && maintenanceSummary == "" {
+		return
+	}
+
+	// reset
+	timeSinceError = time.Time{}
+	lastErrorLineIndex = 0
+	consecutiveThresholdReached = false
+	rateThresholdReached = false
+
+	errorCount := suppressedCount
+	errors := ""
+	plain := ""
+	title := ""
+	severity := severityNone
+	var rules, triggers []string
+	var batches []alertBatch
+	if maintenanceSummary != "" {
+		errors += "<b>" + html.EscapeString(maintenanceSummary) + "</b>\n"
+		plain += maintenanceSummary + "\n"
+		batches = append(batches, alertBatch{text: maintenanceSummary + "\n", errorCount: suppressedCount, severity: severityError})
+		if len(emailBuffer) > 0 {
+			errors += "…<br />\n"
+			plain += "…\n"
+		}
+		severity = severityError
+	}
+	unchanged := 0
+	if cfg.AlertDelta {
+		sent := incidentSentLines
+		incidentSentLines = lineNumbers(emailBuffer)
+		emailBuffer, unchanged = newLines(emailBuffer, sent)
+	}
+	summary := ""
+	if types := typeBreakdown(emailBuffer); len(types) > 0 && !cfg.SummaryOnly {
+		summary, errors = renderTypes(types, errors)
+		plain += summary + "\n"
+	}
+	for i, buf := range emailBuffer {
+		buf = nonEmptyLines(buf, cfg.KeepBlankLines)
+		buf, repeats := foldDuplicates(buf, cfg.FoldDuplicates)
+
+		// render only the first and the last lines of huge batches
+		omitted := 0
+		if cfg.SampleHead+cfg.SampleTail > 0 && len(buf) > cfg.SampleHead+cfg.SampleTail {
+			omitted = len(buf) - cfg.SampleHead - cfg.SampleTail
+		}
+
+		batchStart := len(plain)
+		batch := alertBatch{}
+		for j, line := range buf {
+			if line.Matched {
+				if batch.title == "" {
+					batch.title = alertTitle(cfg, line.Text)
+				}
+				batch.errorCount += repeats[j]
+				batch.severity = max(batch.severity, line.Severity)
+				if line.Rule != "" && !contains(batch.rules, line.Rule) {
+					batch.rules = append(batch.rules, line.Rule)
+				}
+			}
+			if omitted > 0 && j >= cfg.SampleHead && j < len(buf)-cfg.SampleTail {
+				if line.Matched {
+					errorCount += repeats[j]
+				}
+				if j == cfg.SampleHead {
+					errors += "<i>…" + strconv.Itoa(omitted) + " lines omitted…</i>\n"
+					plain += "…" + strconv.Itoa(omitted) + " lines omitted…\n"
+				}
+				continue
+			}
+			text := line.Text
+			if cfg.ShowLineNumbers {
+				text = strconv.FormatUint(line.Number, 10) + ": " + text
+			}
+			if cfg.ShowSource && line.Source != "" {
+				text = "[" + line.Source + "] " + text
+			}
+			if repeats[j] > 1 {
+				text += " (×" + strconv.Itoa(repeats[j]) + ")"
+			}
+			if line.Matched && title == "" {
+				title = alertTitle(cfg, line.Text)
+			}
+			if line.Matched {
+				errors += "<span style=\"color: black\">" + html.EscapeString(text) + "</span>\n"
+				errorCount += repeats[j]
+				severity = max(severity, line.Severity)
+				if line.Rule != "" && !contains(rules, line.Rule) {
+					rules = append(rules, line.Rule)
+				}
+				if line.Trigger != "" && !contains(triggers, line.Trigger) {
+					triggers = append(triggers, line.Trigger)
+				}
+			} else if line.Highlighted {
+				errors += "<span style=\"background-color: #fff3b0\">" + html.EscapeString(text) + "</span>\n"
+			} else {
+				errors += html.EscapeString(text) + "\n"
+			}
+			plain += text + "\n"
+		}
+		batch.text = plain[batchStart:]
+		batches = append(batches, batch)
+		if i < len(emailBuffer)-1 {
+			errors += "…<br />\n"
+			plain += "…\n"
+		}
+	}
+	if cfg.SummaryOnly && len(emailBuffer) > 0 {
+		// the log lines must not leave the host, only the counts are sent
+		summary := summarizeBatches(cfg, emailBuffer)
+		errors, plain = html.EscapeString(summary), summary
+		if maintenanceSummary != "" {
+			errors = "<b>" + html.EscapeString(maintenanceSummary) + "</b>\n" + errors
+			plain = maintenanceSummary + "\n" + plain
+		}
+		title = ""
+		batches = []alertBatch{{text: plain, errorCount: errorCount, severity: severity, rules: rules}}
+	}
+	var notes []string
+	if unchanged > 0 {
+		unchangedNote := "(" + strconv.Itoa(unchanged) + " earlier line(s) unchanged since the previous alert)"
+		errors += "\n<i>" + unchangedNote + "</i>\n"
+		plain += "\n" + unchangedNote + "\n"
+		notes = append(notes, unchangedNote)
+	}
+	if breakdown := groupBreakdown(emailBuffer); breakdown != "" && !cfg.SummaryOnly {
+		breakdownNote := "Errors by " + cfg.GroupBy + ": " + breakdown
+		errors += "\n<b>" + html.EscapeString(breakdownNote) + "</b>\n"
+		plain += "\n" + breakdownNote + "\n"
+		notes = append(notes, breakdownNote)
+	}
+	if cfg.ShowIgnoredCount && ignoredSinceLastEmail > 0 {
+		ignoredNote := strconv.Itoa(ignoredSinceLastEmail) + " more line(s) matched, but were excluded by ERMON_IGNORE_PATTERN"
+		errors += "\n<i>" + ignoredNote + "</i>\n"
+		plain += "\n" + ignoredNote + "\n"
+		notes = append(notes, ignoredNote)
+	}
+	ignoredSinceLastEmail = 0
+	if sampledOutSinceLastEmail > 0 {
+		sampledNote := strconv.Itoa(sampledOutSinceLastEmail) + " more line(s) matched, but were left out by ERMON_SAMPLE_RATE"
+		errors += "\n<i>" + sampledNote + "</i>\n"
+		plain += "\n" + sampledNote + "\n"
+		notes = append(notes, sampledNote)
+		errorCount += sampledOutSinceLastEmail
+	}
+	sampledOutSinceLastEmail = 0
+
+	emailBuffer = nil
+	emailsSent = append(emailsSent, now())
+	incidentAlerted = true
+	stats.alerts++
+	id, thread := newAlertID(), ""
+	if cfg.EmailThreading {
+		if incidentThread == "" {
+			incidentThread = id
+		} else {
+			thread = incidentThread
+		}
+	}
+	previousCount := incidentLastCount
+	incidentLastCount = errorCount
+	outbox <- email{id: id, thread: thread, previousCount: previousCount, errors: errors, errorCount: errorCount, title: title, time: now(), text: plain, severity: severity, rules: rules, triggers: triggers, batches: batches, notes: notes,
+		summary: summary, escalations: escalatedRules(cfg, rules)}
+	if cfg.RecoveryWindow > 0 {
+		recoveryPendingSince = now()
+	}
+}
+
+// sendRecovery sends a notice that there were no errors for ERMON_RECOVERY_WINDOW since the last alert.
+// Every new error postpones it, so flapping errors don't get a notice between the alerts.
+func sendRecovery(cfg Config) {
+	if recoveryPendingSince.IsZero() || len(emailBuffer) > 0 || lastErrorLineIndex > 0 {
+		return
+	}
+	quietSince := recoveryPendingSince
+	if lastErrorAt.After(quietSince) {
+		quietSince = lastErrorAt
+	}
+	if now().Sub(quietSince) < cfg.RecoveryWindow {
+		return
+	}
+	recoveryPendingSince = time.Time{}
+
+	text := "No errors for " + cfg.RecoveryWindow.String() + " since " + formatTime(cfg, quietSince)
+	logInfo(text)
+	outbox <- email{
+		id:        newAlertID(),
+		thread:    incidentThread,
+		errors:    "<span style=\"color: black\">" + html.EscapeString(text) + "</span>\n",
+		title:     "no errors for " + cfg.RecoveryWindow.String(),
+		time:      now(),
+		recovered: true,
+		text:      text + "\n",
+	}
+}
+
+// crashGrace reports whether the alert at the end of a run shorter than a minute is dropped, see ERMON_CRASH_GRACE
+func crashGrace(cfg Config) bool {
+	switch cfg.CrashGrace {
+	case "off":
+		return false
+	case "crash":
+		return inputFailed
+	default:
+		return true
+	}
+}
+
+// lineNumbers returns the positions of the lines in the batches
+func lineNumbers(batches [][]LogLine) map[uint64]bool {
+	numbers := map[uint64]bool{}
+	for _, batch := range batches {
+		for _, line := range batch {
+			if line.seq > 0 {
+				numbers[line.seq] = true
+			}
+		}
+	}
+	return numbers
+}
+
+// newLines drops the lines that were sent in the previous alert, along with the batches that have nothing new,
+// and returns the number of the dropped lines
+func newLines(batches [][]LogLine, sent map[uint64]bool) ([][]LogLine, int) {
+	var result [][]LogLine
+	dropped := 0
+	for _, batch := range batches {
+		var kept []LogLine
+		for _, line := range batch {
+			if line.seq > 0 && sent[line.seq] {
+				dropped++
+				continue
+			}
+			kept = append(kept, line)
+		}
+		if len(kept) > 0 {
+			result = append(result, kept)
+		}
+	}
+	return result, dropped
+}
+
+// summarizeBatches returns the number of matched lines per rule and the time range of the batches, without any log text
+func summarizeBatches(cfg Config, batches [][]LogLine) string {
+	counts := map[string]int{}
+	var labels []string
+	var first, last time.Time
+	for _, buf := range batches {
+		for _, line := range buf {
+			if !line.Matched {
+				continue
+			}
+			label := line.Rule
+			if label == "" && line.Severity == severityWarning {
+				label = "Warnings"
+			} else if label == "" {
+				label = "Errors"
+			}
+			if counts[label] == 0 {
+				labels = append(labels, label)
+			}
+			counts[label]++
+			if first.IsZero() || line.Time.Before(first) {
+				first = line.Time
+			}
+			if line.Time.After(last) {
+				last = line.Time
+			}
+		}
+	}
+
+	summary := ""
+	for _, label := range labels {
+		summary += label + ": " + strconv.Itoa(counts[label]) + "\n"
+	}
+	if !first.IsZero() {
+		summary += "From " + formatTime(cfg, first) + " to " + formatTime(cfg, last) + "\n"
+	}
+	return summary
+}
+
+// batchSeverity returns the highest severity of the matched lines in the batch
+func batchSeverity(buf []LogLine) int {
+	severity := severityNone
+	for _, line := range buf {
+		if line.Matched {
+			severity = max(severity, line.Severity)
+		}
+	}
+	return severity
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// foldDuplicates collapses runs of identical adjacent lines into the first line of the run if fold is set,
+// and returns how many times each of the returned lines was repeated
+func foldDuplicates(lines []LogLine, fold bool) ([]LogLine, []int) {
+	var result []LogLine
+	var repeats []int
+	for _, line := range lines {
+		if n := len(result); fold && n > 0 && result[n-1].Text == line.Text && result[n-1].Source == line.Source && result[n-1].Matched == line.Matched {
+			repeats[n-1]++
+			continue
+		}
+		result = append(result, line)
+		repeats = append(repeats, 1)
+	}
+	return result, repeats
+}
+
+// nonEmptyLines removes the unused slots of the context buffer and, unless keepBlank is set, blank lines
+func nonEmptyLines(lines []LogLine, keepBlank bool) []LogLine {
+	var result []LogLine
+	for _, line := range lines {
+		if len(strings.TrimSpace(line.Text)) > 0 || (keepBlank && line.seq > 0) {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+// inMaintenance reports whether alerts should be suppressed because of planned maintenance
+func inMaintenance(cfg Config) bool {
+	if !cfg.MaintenanceUntil.IsZero() && now().Before(cfg.MaintenanceUntil) {
+		return true
+	}
+	if cfg.MaintenanceFile != "" {
+		if _, err := os.Stat(cfg.MaintenanceFile); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// runPipeline consumes the lines and periodically sends the buffered logs until the input is closed.
+// It's the only goroutine that touches the buffers, so no locking is needed.
+func runPipeline(cfg Config, lines <-chan LogLine) {
+	ticker := time.NewTicker(pipelineTick(cfg))
+	defer ticker.Stop()
+
+	lastLineAt := now()
+	silenceReported := false
+
+	var statsdTick <-chan time.Time
+	var statsd *statsdClient
+	if cfg.StatsdAddr != "" {
+		var err error
+		if statsd, err = newStatsdClient(cfg); err != nil {
+			logError("StatsD error:", err)
+		} else {
+			statsdTicker := time.NewTicker(cfg.StatsdInterval)
+			defer statsdTicker.Stop()
+			statsdTick = statsdTicker.C
+		}
+	}
+
+	for {
+		input := lines
+		if cfg.BlockOnOverflow && len(emailBuffer) >= maxEmailBufferSize {
+			// stop reading until the emailBuffer is consumed, readers will block once the queue is full
+			input = nil
+		}
+
+		select {
+		case line, ok := <-input:
+			if !ok {
+				// with ERMON_SEND_ON_EXIT=false, only what is due anyway is sent
+				finalRun = cfg.SendOnExit
+				sendLogsByEmail(cfg, false)
+				return
+			}
+			lastLineAt = now()
+			silenceReported = false
+			processLine(cfg, line)
+		case <-shutdown:
+			finalRun = cfg.SendOnExit
+			sendLogsByEmail(cfg, false)
+			return
+		case <-ticker.C:
+			if cfg.SilenceTimeout > 0 && !silenceReported && now().Sub(lastLineAt) > cfg.SilenceTimeout {
+				reportSilence(cfg, lastLineAt)
+				silenceReported = true
+				continue
+			}
+			if cfg.ExpectRate > 0 {
+				checkExpectedRate(cfg)
+			}
+			sendLogsByEmail(cfg, false)
+			if cfg.RecoveryWindow > 0 {
+				sendRecovery(cfg)
+			}
+		case <-flushRequests:
+			sendLogsByEmail(cfg, true)
+		case <-stateRequests:
+			dumpState()
+		case <-statsdTick:
+			statsd.report()
+		}
+	}
+}
+
+// pipelineTick returns how often the pipeline checks whether the buffered logs are due
+func pipelineTick(cfg Config) time.Duration {
+	tick := time.Second * 30
+	if cfg.MaxBufferAge > 0 && cfg.MaxBufferAge < tick {
+		// check often enough to send the buffer in time
+		tick = cfg.MaxBufferAge
+	}
+	if cfg.RecoveryWindow > 0 && cfg.RecoveryWindow < tick {
+		tick = cfg.RecoveryWindow
+	}
+	if cfg.ExpectRate > 0 && cfg.ExpectRateWindow < tick {
+		tick = cfg.ExpectRateWindow
+	}
+	if cfg.ErrorWindow < tick {
+		tick = cfg.ErrorWindow
+	}
+	return tick
+}
+
+// sendEmails delivers the composed emails one by one, so slow SMTP servers don't hold up reading the logs
+func sendEmails(cfg Config, done chan<- struct{}) {
+	defer recoverCrash(cfg)
+	channels := alertChannels(cfg)
+	for i := range channels {
+		channels[i].breaker = &circuitBreaker{name: channels[i].name}
+	}
+
+	// send returns the channels that failed, or were paused by their breakers.
+	// If names is set, only these channels are used.
+	// Up to ERMON_SEND_CONCURRENCY channels are used at the same time, so a slow one doesn't delay the others.
+	send := func(e email, names []string) (failed []string) {
+		alert := newAlert(cfg, e)
+		failures := make([]bool, len(channels))
+		slots := make(chan struct{}, cfg.SendConcurrency)
+		var wg sync.WaitGroup
+		for i, c := range channels {
+			if !c.enabled || (names != nil && !contains(names, c.name)) {
+				continue
+			}
+			if !c.breaker.allow() {
+				failures[i] = true
+				continue
+			}
+			slots <- struct{}{}
+			wg.Add(1)
+			go func(i int, c alertChannel) {
+				defer recoverCrash(cfg)
+				defer wg.Done()
+				defer func() { <-slots }()
+				err := c.notifier.Notify(sendContext, alert)
+				if err != nil {
+					logError(c.name+" error:", err)
+					failures[i] = true
+					alertFailures.Add(1)
+				} else {
+					alertsSent.Add(1)
+				}
+				c.breaker.record(cfg, err)
+			}(i, c)
+		}
+		wg.Wait()
+
+		// in the order of the channels, regardless of which one finished first
+		for i, f := range failures {
+			if f {
+				failed = append(failed, channels[i].name)
+			}
+		}
+		return failed
+	}
+
+	var retry <-chan time.Time
+	if cfg.SpoolDir != "" {
+		// the alerts spooled before a restart are retried right away
+		retrySpool(cfg, send)
+		closeSMTP()
+		ticker := time.NewTicker(spoolRetryInterval)
+		defer ticker.Stop()
+		retry = ticker.C
+	}
+
+	for {
+		select {
+		case e, ok := <-outbox:
+			if !ok {
+				close(done)
+				return
+			}
+			if verbosity >= verbosityInfo {
+				fmt.Fprintln(os.Stderr, "[ermon] Sending alert", e.id)
+			}
+			setLastAlert(e)
+			sendingMutex.Lock()
+			sending = &e
+			sendingMutex.Unlock()
+			failed := send(e, nil)
+			sendingMutex.Lock()
+			sending = nil
+			sendingMutex.Unlock()
+			if len(failed) > 0 && cfg.SpoolDir != "" {
+				if err := spoolAlert(cfg, e, failed); err != nil {
+					logError("Error spooling alert:", err)
+				}
+			}
+			if len(outbox) == 0 {
+				// the SMTP connection is reused only for the alerts that are already waiting
+				closeSMTP()
+			}
+		case <-retry:
+			retrySpool(cfg, send)
+			closeSMTP()
+		}
+	}
+}
+
+// alertChannels returns all of the channels, the ones that aren't configured are disabled
+func alertChannels(cfg Config) []alertChannel {
+	builtin := func(send func(ctx context.Context, cfg Config, e email) error) Notifier {
+		return senderNotifier{cfg: cfg, send: send}
+	}
+	channels := []alertChannel{
+		{name: "email", target: cfg.MailTo, enabled: cfg.EmailEnabled, notifier: builtin(sendMail)},
+		{name: "Slack", enabled: cfg.SlackEnabled, notifier: builtin(sendSlack)},
+		{name: "Discord", enabled: cfg.DiscordEnabled, notifier: builtin(sendDiscord)},
+		{name: "socket", target: cfg.SocketPath, enabled: cfg.SocketEnabled, notifier: builtin(sendSocket)},
+		{name: "desktop notification", enabled: cfg.DesktopNotify, notifier: builtin(sendDesktop)},
+		{name: "webhook", enabled: cfg.WebhookEnabled && cfg.WebhookURL != "", notifier: builtin(sendWebhook)},
+		{name: "GitHub", target: cfg.GitHubRepo, enabled: cfg.GitHubEnabled, notifier: builtin(sendGitHubIssue)},
+		{name: "Kafka", target: cfg.KafkaTopic, enabled: cfg.KafkaEnabled, notifier: newKafkaProducer(cfg)},
+		{name: "escalation", enabled: hasEscalations(cfg), notifier: builtin(sendEscalations)},
+	}
+	for i, w := range cfg.Webhooks {
+		channels = append(channels, alertChannel{name: "webhook " + strconv.Itoa(i+1), enabled: cfg.WebhookEnabled, notifier: webhookNotifier{cfg: cfg, dest: w}})
+	}
+	for _, n := range customNotifiers {
+		channels = append(channels, alertChannel{name: n.name, enabled: true, notifier: n.notifier})
+	}
+	return channels
+}
+
+// disableChannels turns off the built-in channels of alertChannels, so only the custom notifiers are used,
+// e.g. when replaying logs
+func (cfg *Config) disableChannels() {
+	cfg.EmailEnabled, cfg.SlackEnabled, cfg.DiscordEnabled, cfg.SocketEnabled, cfg.DesktopNotify = false, false, false, false, false
+	cfg.WebhookEnabled, cfg.GitHubEnabled, cfg.KafkaEnabled = false, false, false
+	for i := range cfg.Rules {
+		cfg.Rules[i].escalation = nil
+	}
+}
+
+// waitForSending waits until sendEmails has sent the remaining alerts, at most ERMON_SHUTDOWN_TIMEOUT.
+// If it takes longer, the alerts that weren't sent are spooled, if ERMON_SPOOL_DIR is set, and it gives up.
+func waitForSending(cfg Config, done <-chan struct{}) {
+	if cfg.ShutdownTimeout <= 0 {
+		<-done
+		return
+	}
+	select {
+	case <-done:
+		return
+	case <-time.After(cfg.ShutdownTimeout):
+	}
+
+	logError("The alerts weren't sent within ERMON_SHUTDOWN_TIMEOUT, exiting anyway")
+	cancelSending()
+	if cfg.SpoolDir == "" {
+		return
+	}
+	var pending []email
+	for e := range outbox {
+		pending = append(pending, e)
+	}
+	sendingMutex.Lock()
+	if sending != nil {
+		// it's not known which channels it was sent through already, so it may be sent twice through some of them
+		pending = append([]email{*sending}, pending...)
+	}
+	sendingMutex.Unlock()
+
+	var channels []string
+	for _, c := range alertChannels(cfg) {
+		if c.enabled {
+			channels = append(channels, c.name)
+		}
+	}
+	for _, e := range pending {
+		if err := spoolAlert(cfg, e, channels); err != nil {
+			logError("Error spooling alert:", err)
+		} else {
+			logInfo("Spooled alert", e.id)
+		}
+	}
+}
+
+// alertChannel is a destination of the alerts
+type alertChannel struct {
+	name     string
+	target   string // where the alerts go, shown with --send-test
+	enabled  bool
+	notifier Notifier
+	breaker  *circuitBreaker
+}
+
+// circuitBreaker pauses sending through a channel after too many consecutive failures,
+// so an outage doesn't turn into a loop of failing attempts
+type circuitBreaker struct {
+	name        string
+	failures    int
+	pausedUntil time.Time
+}
+
+func (b *circuitBreaker) allow() bool {
+	return now().After(b.pausedUntil)
+}
+
+func (b *circuitBreaker) record(cfg Config, err error) {
+	if err == nil {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if cfg.BreakerFailures > 0 && b.failures >= cfg.BreakerFailures {
+		// after the cooldown the next alert is sent as a probe, another failure pauses sending again
+		b.pausedUntil = now().Add(cfg.BreakerCooldown)
+		logError(fmt.Sprintf("Sending via %s paused for %s after %d failures", b.name, cfg.BreakerCooldown, b.failures))
+	}
+}
+
+// reportSilence sends an alert that no lines were read since lastLineAt, along with anything that is buffered
+func reportSilence(cfg Config, lastLineAt time.Time) {
+	text := "The log stream went silent, no new lines since " + formatTime(cfg, lastLineAt)
+	logInfo(text)
+	if len(logBuffer) > 0 {
+		emailBuffer = append(emailBuffer, logBuffer)
+		logBuffer = nil
+	}
+	emailBuffer = append(emailBuffer, []LogLine{{Text: text, Time: now(), Matched: true, Severity: severityError}})
+	consecutiveThresholdReached = true
+	rateThresholdReached = true
+	sendLogsByEmail(cfg, true)
+}
+
+// checkExpectedRate sends an alert when fewer than ERMON_EXPECT_RATE success lines were read within the last ERMON_EXPECT_RATE_WINDOW.
+// It's reported once until the rate is back to normal.
+func checkExpectedRate(cfg Config) {
+	for len(successTimes) > 0 && now().Sub(successTimes[0]) > cfg.ExpectRateWindow {
+		successTimes = successTimes[1:]
+	}
+	if len(successTimes) >= cfg.ExpectRate {
+		lowRateReported = false
+		return
+	}
+	if lowRateReported || now().Sub(startupTime) < cfg.ExpectRateWindow {
+		// the first window isn't over yet
+		return
+	}
+	lowRateReported = true
+
+	text := fmt.Sprintf("Only %d line(s) matching ERMON_SUCCESS_PATTERN in the last %s, expected at least %d", len(successTimes), cfg.ExpectRateWindow, cfg.ExpectRate)
+	logInfo(text)
+	if len(logBuffer) > 0 {
+		emailBuffer = append(emailBuffer, logBuffer)
+		logBuffer = nil
+	}
+	emailBuffer = append(emailBuffer, []LogLine{{Text: text, Time: now(), Matched: true, Severity: severityError}})
+	consecutiveThresholdReached = true
+	rateThresholdReached = true
+	sendLogsByEmail(cfg, true)
+}
+
+// requestStateDump asks the pipeline to print the state of its buffers
+func requestStateDump() {
+	select {
+	case stateRequests <- struct{}{}:
+	default:
+		// a dump is already pending
+	}
+}
+
+// dumpState prints the state of the buffers to stderr, to find out why an alert was or wasn't sent
+func dumpState() {
+	sinceError := "never"
+	if !timeSinceError.IsZero() {
+		sinceError = now().Sub(timeSinceError).Round(time.Second).String() + " ago"
+	}
+	fmt.Fprintf(os.Stderr, "[ermon] State: logBuffer=%d line(s), emailBuffer=%d batch(es), lastErrorLineIndex=%d, timeSinceError=%s, emailsSent=%d in the last hour, lines=%d\n",
+		len(logBuffer), len(emailBuffer), lastErrorLineIndex, sinceError, len(emailsSent), lineNumber)
+}
+
+// requestFlush asks the pipeline to send whatever is buffered
+func requestFlush() {
+	select {
+	case flushRequests <- struct{}{}:
+	default:
+		// a flush is already pending
+	}
+}
+
+// splitLines returns a split function for bufio.Scanner that ends the lines at
+// \n (newline, the default), at \r or \n (cr, for progress updates) or only at \r\n (crlf).
+// Lines longer than maxLineLength are split, so a stream without line breaks doesn't grow the buffer forever.
+func splitLines(mode string) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		var i, size int
+		switch mode {
+		case "cr":
+			i = bytes.IndexAny(data, "\r\n")
+			size = 1
+			if i >= 0 && data[i] == '\r' {
+				if i+1 == len(data) && !atEOF {
+					// it may be \r\n, wait for the next byte
+					return 0, nil, nil
+				}
+				if i+1 < len(data) && data[i+1] == '\n' {
+					size = 2
+				}
+			}
+		case "crlf":
+			i = bytes.Index(data, []byte("\r\n"))
+			size = 2
+		default:
+			i = bytes.IndexByte(data, '\n')
+			size = 1
+		}
+
+		if i >= 0 {
+			return i + size, bytes.TrimRight(data[:i], "\r"), nil
+		}
+		if len(data) >= maxLineLength {
+			return maxLineLength, data[:maxLineLength], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), bytes.TrimRight(data, "\r"), nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// runCommand runs the command, echoing and reading its stdout and stderr separately,
+// and returns its exit code once it exits and both of the streams are read
+func runCommand(command []string, source string, split bufio.SplitFunc, lines chan<- LogLine) int {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		var stderr io.Reader
+		if stderr, err = cmd.StderrPipe(); err == nil {
+			err = cmd.Start()
+			if err == nil {
+				var wg sync.WaitGroup
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					readStream(stdout, source, "stdout", os.Stdout, split, lines)
+				}()
+				go func() {
+					defer wg.Done()
+					readStream(stderr, source, "stderr", os.Stderr, split, lines)
+				}()
+				// the pipes have to be read to the end before waiting for the command
+				wg.Wait()
+				err = cmd.Wait()
+			}
+		}
+	}
+	inputFailed = err != nil
+	close(lines)
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		logError("Error running command:", err)
+		return 1
+	}
+	return 0
+}
+
+// readStream echoes and reads one of the streams of the command, tagging the lines with the stream name
+func readStream(r io.Reader, source string, stream string, echo io.Writer, split bufio.SplitFunc, lines chan<- LogLine) {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(split)
+	for n := uint64(1); scanner.Scan(); n++ {
+		line := scanner.Text()
+		echoLine(echo, line)
+		lines <- LogLine{Text: line, Time: now(), Source: source, Stream: stream, Number: n}
+	}
+	if err := scanner.Err(); err != nil {
+		logError("Scanner error:", err)
+	}
+}
+
+func readLogs(r io.Reader, source string, split bufio.SplitFunc, lines chan<- LogLine) {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(split)
+
+	for n := uint64(1); scanner.Scan(); n++ {
+		line := scanner.Text()
+		echoLine(os.Stdout, line)
+		lines <- LogLine{Text: line, Time: now(), Source: source, Number: n}
+	}
+
+	if err := scanner.Err(); err != nil {
+		logError("Scanner error:", err)
+		inputFailed = true
+	}
+	close(lines)
+}
+
+// followFile works like `tail -F`: it starts at the end of the file, waits for new lines
+// and reopens the file if it gets truncated or rotated
+func followFile(path string, lines chan<- LogLine) {
+	source := filepath.Base(path)
+
+	var file *os.File
+	var reader *bufio.Reader
+	var offset int64
+	var number uint64 // of the last complete line
+	firstOpen := true
+	partial := ""
+
+	for {
+		if file == nil {
+			f, err := os.Open(path)
+			if err != nil {
+				time.Sleep(followPollInterval)
+				continue
+			}
+			file = f
+			reader = bufio.NewReader(file)
+			offset, number = 0, 0
+			if firstOpen {
+				// the first time we open the file we skip to the end, counting the lines, so they keep their numbers
+				var err error
+				if number, offset, err = countLines(file); err != nil {
+					offset, _ = file.Seek(0, io.SeekEnd)
+				}
+				firstOpen = false
+			}
+		}
+
+		chunk, err := reader.ReadString('\n')
+		offset += int64(len(chunk))
+		if err == nil {
+			echoLine(os.Stdout, "["+source+"] "+strings.TrimRight(partial+chunk, "\r\n"))
+			number++
+			lines <- LogLine{Text: strings.TrimRight(partial+chunk, "\r\n"), Time: now(), Source: source, Number: number}
+			partial = ""
+			continue
+		}
+		partial += chunk
+
+		if err != io.EOF {
+			logError("Error reading "+path+":", err)
+		}
+
+		time.Sleep(followPollInterval)
+
+		// reopen the file if it was truncated or replaced
+		info, statErr := os.Stat(path)
+		current, _ := file.Stat()
+		if statErr != nil || current == nil || !os.SameFile(info, current) || info.Size() < offset {
+			// rotated files are read from the beginning
+			file.Close()
+			file = nil
+			partial = ""
+		}
+	}
+}
+
+// countLines reads r to the end and returns the number of the complete lines and of the bytes in it
+func countLines(r io.Reader) (lines uint64, size int64, err error) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := r.Read(buf)
+		lines += uint64(bytes.Count(buf[:n], []byte{'\n'}))
+		size += int64(n)
+		if err == io.EOF {
+			return lines, size, nil
+		} else if err != nil {
+			return lines, size, err
+		}
+	}
+}
+
+func processLine(cfg Config, line LogLine) {
+	lineNumber++
+	i := lineNumber
+	line.seq = i
+	if line.Number == 0 {
+		// the source doesn't number its lines, e.g. the journal
+		line.Number = i
+	}
+
+	if line.match == nil {
+		line = prepareLine(cfg, line)
+	}
+	m := line.match
+
+	success := cfg.SuccessPattern != nil && cfg.SuccessPattern.MatchString(line.Text)
+	if success {
+		successTimes = append(successTimes, line.Time)
+	}
 
-func sendLogsByEmail(cfg Config) {
-	sendLogsMutex.Lock()
+	if cfg.IgnoreBlockStart != nil {
+		// the markers belong to the block, the lines after the end marker are matched as usual
+		if !inIgnoredBlock && cfg.IgnoreBlockStart.MatchString(line.Text) {
+			inIgnoredBlock = true
+		}
+		if inIgnoredBlock && m.severity != severityNone {
+			m.ignored = true
+		}
+		if inIgnoredBlock && cfg.IgnoreBlockEnd.MatchString(line.Text) {
+			inIgnoredBlock = false
+		}
+	}
 
-	// filter emailsSent to only include those within the last hour
-	var newEmailsSent []time.Time
-	for _, t := range emailsSent {
-		if time.Since(t) < time.Hour {
-			newEmailsSent = append(newEmailsSent, t)
+	// the end of the context after an error, it can be a blank line, so it's checked before skipping them
+	isError := m.severity != severityNone && !m.ignored
+	sampledOut := isError && !keepSample(cfg, m.trigger)
+	if sampledOut {
+		// the line is still counted, but it's only used as context
+		isError = false
+		sampledOutSinceLastEmail++
+	}
+	if cfg.ContextEndPattern != nil && lastErrorLineIndex > 0 && cfg.ContextEndPattern.MatchString(line.Text) && !isError {
+		if len(logBuffer) > 0 && !inBurst(cfg, line.Time) {
+			emailBuffer = append(emailBuffer, logBuffer)
+			logBuffer = nil
+			lastErrorLineIndex = 0
 		}
+		return
 	}
-	emailsSent = newEmailsSent
 
-	if len(emailsSent) >= cfg.MaxEmailsPerHour {
-		emailBuffer = nil
-		sendLogsMutex.Unlock()
+	blank := len(strings.TrimSpace(line.Text)) == 0
+	if blank && !cfg.KeepBlankLines {
 		return
 	}
+	if blank {
+		// blank lines are kept as context, but they are never errors
+		isError = false
+	}
+
+	// the batch is closed once it has more than ERMON_FLUSH_THRESHOLD_LINES lines, not counting the history
+	enoughContextInLogBuffer := len(logBuffer)-historyInLogBuffer > cfg.FlushThresholdLines
 
-	if len(logBuffer) > 0 && (finalRun || (!timeSinceError.IsZero() && time.Since(timeSinceError) > runningTimeWindow)) {
+	if enoughContextInLogBuffer {
 		emailBuffer = append(emailBuffer, logBuffer)
 		logBuffer = nil
+		lastErrorLineIndex = 0
 	}
 
-	// don't send email if the app has been running for less than 1 minute and then crashed
-	if finalRun && time.Since(startupTime) < time.Minute && !debug {
-		sendLogsMutex.Unlock()
+	if len(emailBuffer) >= maxEmailBufferSize && !cfg.BlockOnOverflow {
+		// the emailBuffer is full, drop the line.
+		// With ERMON_OVERFLOW=block the pipeline stops reading once it's full, the line that filled it is kept
 		return
 	}
 
-	if len(emailBuffer) == 0 {
-		sendLogsMutex.Unlock()
+	if cfg.ResetPattern != nil && cfg.ResetPattern.MatchString(line.Text) {
+		if cfg.AlertOnce && incidentAlerted {
+			// the incident was reported already, the rest of it isn't sent
+			clearIncident("reset line")
+		}
+		incidentThread = ""
+		incidentLastCount = 0
+		incidentSentLines = nil
+		// the incident is over, close the current batch and don't use anything before this line as context
+		if len(logBuffer) > 0 {
+			line.Text = redact(cfg, line.Text)
+			emailBuffer = append(emailBuffer, append(logBuffer, line))
+			logBuffer = nil
+		}
+		lastErrorLineIndex = 0
+		runningContextBuffer = [maxContextBuffer]LogLine{}
+		highlightBuffer = nil
+		historyBuffer = nil
+		consecutiveErrors = 0
 		return
 	}
 
-	// reset
-	timeSinceError = time.Time{}
-	lastErrorLineIndex = 0
+	line.Matched = isError
+	if line.Matched {
+		line.Severity = m.severity
+		line.Rule = m.rule
+		line.Trigger = m.trigger
+		line.Group = m.group
+		line.Type = m.errType
+		recordRuleMatch(cfg, line)
+	} else if m.severity == severityNone && !blank && (cfg.SuccessPattern == nil || success) {
+		// the errors are no longer in a row, with ERMON_SUCCESS_PATTERN only its lines count as a success
+		consecutiveErrors = 0
+		consecutiveStart = time.Time{}
+	}
+	if !blank {
+		stats.lines++
+	}
+	if line.Matched || sampledOut {
+		stats.errors++
+	}
+	if m.ignored && !blank {
+		stats.ignored++
+		ignoredSinceLastEmail++
+	}
 
-	errorCount := 0
-	errors := ""
-	for i, buf := range emailBuffer {
-		for _, line := range buf {
-			if len(strings.TrimSpace(line)) == 0 {
-				continue
+	if cfg.ThreadPattern != nil {
+		// lines without the thread ID, e.g. stack traces, belong to the thread of the previous line
+		if m := cfg.ThreadPattern.FindStringSubmatch(line.Text); m != nil {
+			lastThread = m[1]
+		}
+		line.Thread = lastThread
+	}
+	line.Highlighted = cfg.HighlightPattern != nil && !line.Matched && cfg.HighlightPattern.MatchString(line.Text)
+
+	// redact after matching, so sensitive data doesn't prevent detecting errors
+	line.Text = redact(cfg, line.Text)
+
+	if line.Matched {
+		if cfg.AlertOnce && incidentAlerted && cfg.AlertOnceTimeout > 0 && line.Time.Sub(lastErrorAt) > cfg.AlertOnceTimeout {
+			clearIncident("no errors for " + cfg.AlertOnceTimeout.String())
+		}
+		if cfg.AlertOnceTimeout > 0 && line.Time.Sub(lastErrorAt) > cfg.AlertOnceTimeout {
+			// the next alert starts a new thread and isn't compared with the previous one
+			incidentThread = ""
+			incidentLastCount = 0
+			incidentSentLines = nil
+		}
+		lastErrorAt = line.Time
+
+		// count errors that follow each other without a reset within the configured window
+		if consecutiveErrors == 0 || line.Time.Sub(consecutiveStart) > cfg.ConsecutiveWindow {
+			consecutiveErrors = 0
+			consecutiveStart = line.Time
+		}
+		consecutiveErrors++
+		if consecutiveErrors >= cfg.ConsecutiveThreshold {
+			consecutiveThresholdReached = true
+		}
+
+		// sliding error rate per minute over the configured window
+		if cfg.RateThreshold > 0 {
+			errorTimes = append(errorTimes, line.Time)
+			for len(errorTimes) > 0 && line.Time.Sub(errorTimes[0]) > cfg.RateWindow {
+				errorTimes = errorTimes[1:]
 			}
-			if lineContainsError(cfg, line) {
-				errors += "<span style=\"color: black\">" + html.EscapeString(line) + "</span>\n"
-				errorCount++
-			} else {
-				errors += html.EscapeString(line) + "\n"
+			if float64(len(errorTimes))/cfg.RateWindow.Minutes() >= cfg.RateThreshold {
+				rateThresholdReached = true
 			}
 		}
-		if i < len(emailBuffer)-1 {
-			errors += "…<br />\n"
+
+		// record the time so we can track number of errors per configured time period
+		// this time will be reset when email is sent
+		timeSinceError = now()
+
+		if lastErrorLineIndex == 0 {
+			burstStart = line.Time
+			historyInLogBuffer = 0
+			// when the batch was just closed for its size, the lines before this one are in it already
+			if !enoughContextInLogBuffer {
+				context := runningContextBuffer[:]
+				useHistory := cfg.HistoryLines > maxContextBuffer && line.Severity == severityError
+				if useHistory {
+					// errors get the deep context, warnings only the usual one
+					context = historyBuffer
+				}
+				context = append(highlightsOutsideContext(context), context...)
+				if cfg.ThreadPattern != nil {
+					context = sameThread(context, line.Thread)
+				}
+				if useHistory {
+					historyInLogBuffer = len(context)
+				}
+				logBuffer = append(logBuffer, context...)
+			}
+			highlightBuffer = nil
+			batchThread = line.Thread
 		}
+
+		logBuffer = append(logBuffer, line)
+		lastErrorLineIndex = i
 	}
 
-	emailBuffer = nil
-	sendLogsMutex.Unlock()
+	// keep the highlighted lines before the first error, even if they are too far from it
+	if line.Highlighted && lastErrorLineIndex == 0 {
+		highlightBuffer = append(highlightBuffer, line)
+		if len(highlightBuffer) > maxContextBuffer {
+			highlightBuffer = highlightBuffer[1:]
+		}
+	}
 
-	emailsSent = append(emailsSent, time.Now())
-	sendMail(cfg, errors, errorCount)
-}
+	if cfg.HistoryLines > 0 {
+		if len(historyBuffer) >= cfg.HistoryLines {
+			historyBuffer = append(historyBuffer[1:], line)
+		} else {
+			historyBuffer = append(historyBuffer, line)
+		}
+	}
 
-func watchLogBuffer(cfg Config) {
-	for {
-		sendLogsByEmail(cfg)
+	// maintain a buffer of last contextSize
+	if len(runningContextBuffer) >= maxContextBuffer {
+		copy(runningContextBuffer[:], runningContextBuffer[1:])
+		runningContextBuffer[maxContextBuffer-1] = line
+	} else {
+		runningContextBuffer[len(logBuffer)] = line
+	}
 
-		if finalRun {
-			return
-		}
+	// keep adding some context after an error occurs,
+	// either a fixed number of lines or until a line matching the end pattern
+	notTooFarFromLastError := lastErrorLineIndex > 0 && lastErrorLineIndex != i && (cfg.ContextEndPattern != nil || (i-lastErrorLineIndex) < maxContextBuffer)
+	highlightAfterError := line.Highlighted && lastErrorLineIndex > 0 && lastErrorLineIndex != i
+	otherThread := cfg.ThreadPattern != nil && line.Thread != batchThread
+	if (notTooFarFromLastError || highlightAfterError) && !otherThread && !enoughContextInLogBuffer {
+		logBuffer = append(logBuffer, line)
+	}
+
+	// push log buffer to email buffer, unless more errors of the same burst may follow
+	if len(logBuffer) > 0 && cfg.ContextEndPattern == nil && (i-lastErrorLineIndex) >= maxContextBuffer && !inBurst(cfg, line.Time) {
+		emailBuffer = append(emailBuffer, logBuffer)
+		logBuffer = nil
+		lastErrorLineIndex = 0
+	}
+}
 
-		time.Sleep(time.Second * 30)
+// sameThread returns the lines of the given thread
+func sameThread(lines []LogLine, thread string) []LogLine {
+	var result []LogLine
+	for _, line := range lines {
+		if line.Thread == thread {
+			result = append(result, line)
+		}
 	}
+	return result
 }
 
-func readLogs(cfg Config, r io.Reader) {
-	scanner := bufio.NewScanner(r)
-	var i uint64 = 0 // line number
-	var runningContextBuffer [maxContextBuffer]string
+// highlightsOutsideContext returns the buffered highlighted lines that are not in the context
+func highlightsOutsideContext(context []LogLine) []LogLine {
+	var lines []LogLine
+	for _, h := range highlightBuffer {
+		inContext := false
+		for _, c := range context {
+			if c.seq == h.seq {
+				inContext = true
+				break
+			}
+		}
+		if !inContext {
+			lines = append(lines, h)
+		}
+	}
+	return lines
+}
 
-	for scanner.Scan() {
-		i++
-		line := scanner.Text()
-		fmt.Println(line)
+// prepareLine cleans up the line and matches it against the patterns.
+// Unlike processLine, it doesn't touch any shared state, so it can be called from several goroutines.
+func prepareLine(cfg Config, line LogLine) LogLine {
+	if cfg.SanitizeUTF8 {
+		line.Text = strings.ToValidUTF8(line.Text, "\uFFFD")
+	}
+	if cfg.StripANSI {
+		line.Text = ansiPattern.ReplaceAllString(line.Text, "")
+	}
+	if cfg.MatchStream != "" && line.Stream != "" && line.Stream != cfg.MatchStream {
+		// the line is still echoed and used as context, but it's never an error
+		line.match = &lineMatch{}
+		return line
+	}
+	text := line.Text
+	for _, t := range cfg.LineTransforms {
+		text = t.pattern.ReplaceAllString(text, t.replacement)
+	}
+	if cfg.StoreTransformed {
+		line.Text = text
+	}
+	severity, ruleName, trigger, ignored := matchLine(cfg, text)
+	line.match = &lineMatch{severity: severity, rule: ruleName, trigger: trigger, ignored: ignored}
+	if cfg.GroupBy != "" && severity != severityNone {
+		line.match.group = captureGroup(cfg, text)
+	}
+	if cfg.TypePattern != nil && severity != severityNone {
+		line.match.errType = captureType(cfg, text)
+	}
+	return line
+}
 
-		if len(strings.TrimSpace(line)) == 0 {
+// captureGroup returns the value of the ERMON_GROUP_BY capture group of the first pattern that has it and matches the line
+func captureGroup(cfg Config, input string) string {
+	patterns := []*regexp.Regexp{cfg.WarningPattern}
+	for _, r := range cfg.Rules {
+		patterns = append(patterns, r.patterns...)
+	}
+	for _, p := range patterns {
+		if p == nil || p.SubexpIndex(cfg.GroupBy) < 0 {
 			continue
 		}
-
-		enoughContextInLogBuffer := len(logBuffer) > maxContextBuffer*3
-
-		if enoughContextInLogBuffer {
-			emailBuffer = append(emailBuffer, logBuffer)
-			logBuffer = nil
-			lastErrorLineIndex = 0
+		if m := p.FindStringSubmatch(input); m != nil && m[p.SubexpIndex(cfg.GroupBy)] != "" {
+			return m[p.SubexpIndex(cfg.GroupBy)]
 		}
+	}
+	return ""
+}
 
-		if len(emailBuffer) >= maxEmailBufferSize {
-			// wait for the emailBuffer to be consumed
-			continue
+// groupBreakdown counts the matched lines by their ERMON_GROUP_BY value, e.g. "/api/pay: 12, /api/login: 3"
+func groupBreakdown(batches [][]LogLine) string {
+	counts := map[string]int{}
+	var groups []string
+	for _, buf := range batches {
+		for _, line := range buf {
+			if !line.Matched || line.Group == "" {
+				continue
+			}
+			if counts[line.Group] == 0 {
+				groups = append(groups, line.Group)
+			}
+			counts[line.Group]++
 		}
+	}
+	// the most frequent first, ties in the order of appearance
+	sort.SliceStable(groups, func(i, j int) bool { return counts[groups[i]] > counts[groups[j]] })
 
-		if lineContainsError(cfg, line) {
-			// record the time so we can track number of errors per configured time period
-			// this time will be reset when email is sent
-			timeSinceError = time.Now()
+	parts := make([]string, len(groups))
+	for i, group := range groups {
+		parts[i] = group + ": " + strconv.Itoa(counts[group])
+	}
+	return strings.Join(parts, ", ")
+}
 
-			if lastErrorLineIndex == 0 {
-				logBuffer = append(logBuffer, runningContextBuffer[:]...)
-			}
+// captureType returns the first capture group of ERMON_TYPE_PATTERN, or "Other" if the pattern doesn't match the line
+func captureType(cfg Config, input string) string {
+	if m := cfg.TypePattern.FindStringSubmatch(input); m != nil && m[1] != "" {
+		return m[1]
+	}
+	return "Other"
+}
 
-			if !enoughContextInLogBuffer {
-				logBuffer = append(logBuffer, line)
+type typeCount struct {
+	name  string
+	count int
+}
+
+// typeBreakdown counts the matched lines by their ERMON_TYPE_PATTERN type, the most frequent first and "Other" last
+func typeBreakdown(batches [][]LogLine) []typeCount {
+	var types []typeCount
+	for _, buf := range batches {
+		for _, line := range buf {
+			if !line.Matched || line.Type == "" {
+				continue
 			}
-			lastErrorLineIndex = i
+			i := 0
+			for i < len(types) && types[i].name != line.Type {
+				i++
+			}
+			if i == len(types) {
+				types = append(types, typeCount{name: line.Type})
+			}
+			types[i].count++
 		}
-
-		// maintain a buffer of last contextSize
-		if len(runningContextBuffer) >= maxContextBuffer {
-			copy(runningContextBuffer[:], runningContextBuffer[1:])
-			runningContextBuffer[maxContextBuffer-1] = line
-		} else {
-			runningContextBuffer[len(logBuffer)] = line
+	}
+	sort.SliceStable(types, func(i, j int) bool {
+		if (types[i].name == "Other") != (types[j].name == "Other") {
+			return types[j].name == "Other"
 		}
+		return types[i].count > types[j].count
+	})
+	return types
+}
+
+// renderTypes returns the plain text table of the types and adds the HTML one before the errors
+func renderTypes(types []typeCount, errors string) (string, string) {
+	width := 0
+	for _, t := range types {
+		width = max(width, utf8.RuneCountInString(t.name))
+	}
+	plain := "Errors by type:\n"
+	// the errors are in a <pre>, so the table has no line breaks
+	table := "<table style=\"margin-bottom: 10px; border-collapse: collapse;\">"
+	for _, t := range types {
+		plain += fmt.Sprintf("  %-*s %d\n", width, t.name, t.count)
+		table += "<tr><td style=\"padding-right: 20px;\">" + html.EscapeString(t.name) + "</td><td>" + strconv.Itoa(t.count) + "</td></tr>"
+	}
+	return plain, "<b>Errors by type:</b>\n" + table + "</table>" + errors
+}
+
+// matchInParallel prepares the lines using several goroutines and passes them on in the original order
+func matchInParallel(cfg Config, lines <-chan LogLine, workers int) <-chan LogLine {
+	type job struct {
+		line   LogLine
+		result chan LogLine
+	}
 
-		// keep adding some context after an error occurs
-		notTooFarFromLastError := lastErrorLineIndex > 0 && lastErrorLineIndex != i && (i-lastErrorLineIndex) < maxContextBuffer
-		if notTooFarFromLastError && !enoughContextInLogBuffer {
-			logBuffer = append(logBuffer, line)
+	jobs := make(chan job, workers)
+	results := make(chan chan LogLine, lineQueueSize) // keeps the order of the lines
+	out := make(chan LogLine, lineQueueSize)
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer recoverCrash(cfg)
+			for j := range jobs {
+				j.result <- prepareLine(cfg, j.line)
+			}
+		}()
+	}
+
+	go func() {
+		defer recoverCrash(cfg)
+		for line := range lines {
+			result := make(chan LogLine, 1)
+			results <- result
+			jobs <- job{line: line, result: result}
 		}
+		close(jobs)
+		close(results)
+	}()
 
-		// push log buffer to email buffer
-		if len(logBuffer) > 0 && (i-lastErrorLineIndex) == maxContextBuffer {
-			emailBuffer = append(emailBuffer, logBuffer)
-			logBuffer = nil
-			lastErrorLineIndex = 0
+	go func() {
+		defer recoverCrash(cfg)
+		for result := range results {
+			out <- <-result
 		}
+		close(out)
+	}()
+
+	return out
+}
+
+// clearIncident ends the incident that was reported with ERMON_ALERT_ONCE, dropping the rest of its lines
+func clearIncident(reason string) {
+	logInfo("The incident is over (" + reason + "), the next error will be reported")
+	incidentAlerted = false
+	incidentThread = ""
+	incidentLastCount = 0
+	incidentSentLines = nil
+	emailBuffer = nil
+	logBuffer = nil
+	lastErrorLineIndex = 0
+}
+
+// redact replaces sensitive data in the line with ***
+func redact(cfg Config, text string) string {
+	if cfg.RedactPattern == nil {
+		return text
 	}
+	return cfg.RedactPattern.ReplaceAllString(text, "***")
+}
 
-	if err := scanner.Err(); err != nil {
-		fmt.Println("[ermon] Scanner error:", err)
+// inBurst reports whether the errors are still being collected into the same batch
+func inBurst(cfg Config, now time.Time) bool {
+	return cfg.BurstWindow > 0 && !burstStart.IsZero() && now.Sub(burstStart) < cfg.BurstWindow
+}
+
+// keepSample reports whether the matched line is kept with ERMON_SAMPLE_RATE.
+// Every trigger is sampled separately: the first line is kept and then about one in 1/rate lines.
+func keepSample(cfg Config, trigger string) bool {
+	if cfg.SampleRate >= 1 {
+		return true
 	}
+	n := sampleCounts[trigger]
+	sampleCounts[trigger]++
+	return n == 0 || int(float64(n)*cfg.SampleRate) != int(float64(n-1)*cfg.SampleRate)
 }
 
 func lineContainsError(cfg Config, input string) bool {
-	if cfg.IgnorePattern != nil {
-		if cfg.IgnorePattern.MatchString(input) {
-			return false
+	severity, _, _, ignored := matchLine(cfg, input)
+	return severity != severityNone && !ignored
+}
+
+// matchLine returns the severity of the line (severityNone if it doesn't match any pattern),
+// the name of the matched rule, what triggered the match and whether the line is excluded by the ignore pattern
+func matchLine(cfg Config, input string) (severity int, ruleName string, trigger string, ignored bool) {
+	for _, r := range cfg.Rules {
+		if r.match(input) {
+			severity = severityError
+			ruleName = r.name
+			trigger = r.String()
+			break
 		}
 	}
-	if cfg.MatchPattern.MatchString(input) {
-		return true
+	if severity == severityNone && (cfg.MatchMinLen > 0 || cfg.MatchMaxLen > 0) {
+		// truncated or oversized lines, blank lines are never errors
+		length := utf8.RuneCountInString(input)
+		if length > 0 && length < cfg.MatchMinLen {
+			severity = severityError
+			trigger = "ERMON_MATCH_MIN_LEN"
+		} else if cfg.MatchMaxLen > 0 && length > cfg.MatchMaxLen {
+			severity = severityError
+			trigger = "ERMON_MATCH_MAX_LEN"
+		}
 	}
-	return false
+	if severity == severityNone && cfg.WarningPattern != nil && cfg.WarningPattern.MatchString(input) {
+		severity = severityWarning
+		trigger = cfg.WarningPattern.String()
+	}
+	if severity != severityNone && cfg.IgnorePattern != nil {
+		ignored = cfg.IgnorePattern.MatchString(input)
+	}
+	return severity, ruleName, trigger, ignored
+}
+
+// alertTitle turns an error line into a short title by removing the leading timestamp and truncating it
+func alertTitle(cfg Config, line string) string {
+	if cfg.TitleStripPattern != nil {
+		line = cfg.TitleStripPattern.ReplaceAllString(line, "")
+	}
+	title := []rune(strings.TrimSpace(line))
+	if len(title) > maxTitleLength {
+		return strings.TrimSpace(string(title[:maxTitleLength-1])) + "…"
+	}
+	return string(title)
+}
+
+func emailSubject(cfg Config, e email) string {
+	var subject string
+	if e.test {
+		subject = "[Test] " + cfg.AppName + ": " + e.title
+	} else if e.crash {
+		subject = "[Crash] " + cfg.AppName + ": " + e.title
+	} else if e.recovered {
+		subject = "[Recovered] " + cfg.AppName + ": " + e.title
+	} else if cfg.SubjectTitle && e.title != "" {
+		subject = "[Alert] " + cfg.AppName + ": " + e.title
+	} else {
+		subject = "[Alert] " + cfg.AppName + " reported " + strconv.Itoa(e.errorCount) + " error(s)"
+		if cfg.SubjectDelta && e.previousCount > 0 && e.previousCount != e.errorCount {
+			trend := "up"
+			if e.errorCount < e.previousCount {
+				trend = "down"
+			}
+			subject += " (" + trend + " from " + strconv.Itoa(e.previousCount) + ")"
+		}
+		if len(e.rules) > 0 {
+			subject += ": " + strings.Join(e.rules, ", ")
+		}
+	}
+	if e.id != "" {
+		subject += " #" + e.id
+	}
+	if prefix := severityPrefixes[cfg.SeverityPrefix][e.severity]; prefix != "" && !e.test {
+		subject = prefix + " " + subject
+	}
+	return subject
+}
+
+// newAlertID returns a short ID made of the current time and a random suffix, e.g. "mgs3k1xq-9f2c"
+func newAlertID() string {
+	suffix := make([]byte, 2)
+	rand.Read(suffix)
+	return strconv.FormatInt(now().UnixMilli(), 36) + "-" + hex.EncodeToString(suffix)
 }
 
-func sendMail(cfg Config, errors string, errorCount int) {
+// alertBanner renders ERMON_ALERT_HEADER or ERMON_ALERT_FOOTER with the {app} and {host} placeholders filled in.
+// The text is HTML, so it can contain links.
+func alertBanner(cfg Config, text string) string {
+	if text == "" {
+		return ""
+	}
+	host, _ := os.Hostname()
+	text = strings.Replace(text, "{app}", html.EscapeString(cfg.AppName), -1)
+	text = strings.Replace(text, "{host}", html.EscapeString(host), -1)
+	return "<div style=\"color: black; margin: 10px 0;\">" + text + "</div>"
+}
+
+// triggerFooter lists what triggered the alert and the profile for the footer of the email,
+// it's empty unless ERMON_SHOW_TRIGGER is enabled
+func triggerFooter(cfg Config, e email) string {
+	if !cfg.ShowTrigger {
+		return ""
+	}
+	footer := ""
+	if len(e.triggers) > 0 {
+		footer += "<br />\n        triggered by " + html.EscapeString(strings.Join(e.triggers, ", "))
+	}
+	if cfg.Profile != "" {
+		footer += "<br />\n        profile " + html.EscapeString(cfg.Profile)
+	}
+	return footer
+}
+
+// messageID turns the alert ID into a Message-ID in the domain of ERMON_MAIL_FROM, e.g. <mgs3k1xq-9f2c@example.com>
+func messageID(cfg Config, id string) string {
+	domain := "ermon"
+	if address, err := mail.ParseAddress(cfg.MailFrom); err == nil {
+		domain = address.Address[strings.LastIndex(address.Address, "@")+1:]
+	}
+	return "<" + id + "@" + domain + ">"
+}
+
+// emailBody renders the alert with the HTML template
+func emailBody(cfg Config, e email) string {
+	body := strings.Replace(mailTemplate, "{date}", formatTime(cfg, e.time), -1)
+	body = strings.Replace(body, "{id}", e.id, -1)
+	body = strings.Replace(body, "{trigger}", triggerFooter(cfg, e), -1)
+	body = strings.Replace(body, "{header}", alertBanner(cfg, cfg.AlertHeader), -1)
+	body = strings.Replace(body, "{footer}", alertBanner(cfg, cfg.AlertFooter), -1)
+	// the log lines go last, so placeholders in them are left alone
+	return strings.Replace(body, "{errors}", e.errors, -1)
+}
+
+// limitBody cuts the log lines, so the body of the email is at most ERMON_MAX_BODY_BYTES and the template stays intact
+func limitBody(cfg Config, e email) email {
+	if cfg.Plaintext {
+		e.text = truncateText(e.text, cfg.MaxBodyBytes)
+		return e
+	}
+	withoutErrors := e
+	withoutErrors.errors = ""
+	e.errors = truncateText(e.errors, max(cfg.MaxBodyBytes-len(emailBody(cfg, withoutErrors)), minBodyBytes))
+	return e
+}
+
+func sendMail(ctx context.Context, cfg Config, e email) error {
 	smtpPort := "25"
 	if cfg.SMTPPort != "" {
 		smtpPort = cfg.SMTPPort
 	}
 
-	errorCountString := strconv.Itoa(errorCount)
-	body := strings.Replace(mailTemplate, "{errors}", errors, -1)
 	var auth smtp.Auth
 	if cfg.SMTPUsername != "" && cfg.SMTPPassword != "" {
 		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
 	}
-	recipients := []string{cfg.MailTo}
-	message := []byte("From: " + cfg.MailFrom + "\r\n" +
-		"To: " + cfg.MailTo + "\r\n" +
-		"Subject: [Alert] " + cfg.AppName + " reported " + errorCountString + " error(s)\r\n" +
-		"Content-Type: text/html; charset=UTF-8\r\n\r\n" +
+	recipients := []string{stripLineBreaks(cfg.MailTo)}
+	message := mailMessage(cfg, e)
+
+	if cfg.SendmailPath != "" {
+		return sendmail(ctx, cfg, message)
+	}
+
+	return sendSMTP(ctx, cfg.SMTPHost+":"+smtpPort, cfg.SMTPHost, auth, stripLineBreaks(cfg.MailFrom), recipients, message)
+}
+
+// mailMessage returns the headers and the body of the email
+func mailMessage(cfg Config, e email) []byte {
+	if cfg.MaxBodyBytes > 0 {
+		e = limitBody(cfg, e)
+	}
+	body := emailBody(cfg, e)
+	// user-controlled values can't be trusted to be free of line breaks, which would allow injecting headers
+	headers := "From: " + stripLineBreaks(cfg.MailFrom) + "\r\n" +
+		"To: " + stripLineBreaks(cfg.MailTo) + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", stripLineBreaks(emailSubject(cfg, e))) + "\r\n" +
+		"Date: " + e.time.In(cfg.Location).Format(time.RFC1123Z) + "\r\n" +
+		"Message-ID: " + messageID(cfg, e.id) + "\r\n"
+	if e.thread != "" {
+		// follow-ups of an incident are grouped with its first alert by the mail clients
+		headers += "In-Reply-To: " + messageID(cfg, e.thread) + "\r\n" +
+			"References: " + messageID(cfg, e.thread) + "\r\n"
+	}
+	if cfg.ReplyTo != "" {
+		headers += "Reply-To: " + cfg.ReplyTo + "\r\n"
+	}
+	for _, h := range cfg.ExtraHeaders {
+		headers += h.name + ": " + h.value + "\r\n"
+	}
+	contentType := "text/html"
+	if cfg.Plaintext {
+		// only the lines, for gateways that strip or quarantine HTML
+		contentType = "text/plain"
+		body = e.text
+	}
+	return []byte(headers +
+		"Content-Type: " + contentType + "; charset=UTF-8\r\n\r\n" +
 		body + "\r\n")
+}
 
-	err := smtp.SendMail(cfg.SMTPHost+":"+smtpPort, auth, cfg.MailFrom, recipients, message)
-	if err != nil {
-		fmt.Println("[ermon] SendMail error:", err)
+// sendTestAlert sends a sample alert through every configured channel and reports whether all of them succeeded
+func sendTestAlert(cfg Config) bool {
+	text := "This is a test from ermon"
+	e := email{
+		id:         newAlertID(),
+		errors:     "<span style=\"color: black\">" + html.EscapeString(text) + "</span>\n",
+		errorCount: 1,
+		title:      text,
+		time:       now(),
+		test:       true,
+		text:       text + "\n",
+		severity:   severityError,
+	}
+	return deliver(cfg, e)
+}
+
+// deliver sends the alert through all of the enabled channels right away, bypassing the outbox,
+// and reports whether all of them succeeded
+func deliver(cfg Config, e email) bool {
+	ok := true
+	alert := newAlert(cfg, e)
+	for _, c := range alertChannels(cfg) {
+		if !c.enabled {
+			continue
+		}
+		name := strings.ToLower(c.name)
+		if err := c.notifier.Notify(context.Background(), alert); err != nil {
+			fmt.Println("[ermon] "+name+": failed:", err)
+			ok = false
+		} else if c.target != "" {
+			fmt.Println("[ermon] "+name+": sent to", c.target)
+		} else {
+			fmt.Println("[ermon] " + name + ": sent")
+		}
+	}
+	closeSMTP()
+	return ok
+}
+
+// recoverCrash reports a panic of ermon itself through the enabled channels and exits,
+// so it doesn't stop monitoring unnoticed. It has to be deferred at the top of every goroutine.
+func recoverCrash(cfg Config) {
+	r := recover()
+	if r == nil {
 		return
 	}
+	crashMutex.Lock() // the first panic is reported, the others wait for the exit
+
+	stack := make([]byte, 64*1024)
+	stack = stack[:runtime.Stack(stack, false)]
+	fmt.Fprintf(os.Stderr, "[ermon] panic: %v\n%s", r, stack)
+
+	text := fmt.Sprintf("ermon crashed, the logs are no longer monitored: %v", r)
+	deliver(cfg, email{
+		id:         newAlertID(),
+		errors:     "<span style=\"color: black\">" + html.EscapeString(text) + "</span>\n" + html.EscapeString(string(stack)),
+		errorCount: 1,
+		title:      text,
+		time:       now(),
+		crash:      true,
+		text:       text + "\n" + string(stack),
+		severity:   severityError,
+	})
+	os.Exit(2)
+}
+
+// formatTime renders the time in the configured timezone
+func formatTime(cfg Config, t time.Time) string {
+	return t.In(cfg.Location).Format("2006-01-02 15:04:05 MST")
+}
+
+func stripLineBreaks(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+// sendmail pipes the message to the local sendmail binary, which reads the recipients from the headers
+func sendmail(ctx context.Context, cfg Config, message []byte) error {
+	cmd := exec.CommandContext(ctx, cfg.SendmailPath, "-t", "-i", "-f", stripLineBreaks(cfg.MailFrom))
+	cmd.Stdin = bytes.NewReader(message)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
 }
 
 var mailTemplate = `
@@ -223,165 +1955,213 @@ var mailTemplate = `
     </div>
     <div style="padding: 30px;">
       <div style="background-color: #fff; padding: 20px; border-radius: 4px; font-size: 14px; color: #808080;">
-        <pre style="font-family: monospace; white-space: pre-wrap;">{errors}</pre>
+        {header}<pre style="font-family: monospace; white-space: pre-wrap;">{errors}</pre>{footer}
       </div>
       <div style="margin-top: 20px; padding: 10px; font-size: 15px; color: #9a9ea6; text-align: center;">
         This email alert was produced by
         <a href="https://github.com/gornostal/ermon" style="color: #9a9ea6; text-decoration: underline">ermon</a> v` + version + `
+        on {date}, alert {id}{trigger}
       </div>
     </div>
   </body>
 </html>
 `
 
-type Config struct {
-	SMTPHost         string
-	SMTPPort         string
-	SMTPUsername     string
-	SMTPPassword     string
-	AppName          string
-	MailFrom         string
-	MailTo           string
-	MaxEmailsPerHour int
-	MatchPattern     *regexp.Regexp
-	IgnorePattern    *regexp.Regexp
-}
-
-func parseConfig(filename string) (*Config, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("error opening config file: %s", err)
-	}
-	defer file.Close()
-
-	cfg := &Config{}
-
-	var matchPattern string
-	var ignorePattern string
-	var maxEmailsPerHour string
+func main() {
+	var cfgPaths []string
+	var cfgStdin bool
+	var logFiles []string
+	var sendTest bool
+	var replayPath string
+	var command []string
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) == 0 || line[0] == '#' {
-			continue
+	args := os.Args[1:]
+parseArgs:
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; arg {
+		case "--":
+			// everything after -- is the command to run and monitor
+			command = args[i+1:]
+			break parseArgs
+		case "-h", "--help", "version":
+			fmt.Println("ermon v" + version + " by Oleksandr Gornostal")
+			fmt.Println("\033[37mFor usage and configuration, see https://github.com/gornostal/ermon\033[0m")
+			os.Exit(0)
+		case "-f":
+			if i+1 >= len(args) {
+				fmt.Println("[ermon] -f requires a file path")
+				os.Exit(1)
+			}
+			i++
+			logFiles = append(logFiles, args[i])
+		case "--send-test":
+			sendTest = true
+		case "--demo":
+			// runs on its own config, so it works without any setup
+			os.Exit(runDemo())
+		case "--replay":
+			if i+1 >= len(args) {
+				fmt.Println("[ermon] --replay requires a file path")
+				os.Exit(1)
+			}
+			i++
+			replayPath = args[i]
+		case "-":
+			cfgStdin = true
+		default:
+			cfgPaths = append(cfgPaths, arg)
 		}
+	}
 
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			// ignore invalid lines
-			continue
+	// the config can be passed without a file, as the value of ERMON_CONFIG or on stdin
+	var cfgBody io.Reader
+	if cfgStdin {
+		if len(command) == 0 && len(logFiles) == 0 && !sendTest {
+			fmt.Println("[ermon] The config can only be read from stdin when running a command or following files")
+			os.Exit(1)
 		}
-
-		switch strings.TrimSpace(parts[0]) {
-		case "SMTP_HOST":
-			cfg.SMTPHost = strings.TrimSpace(parts[1])
-		case "SMTP_PORT":
-			cfg.SMTPPort = strings.TrimSpace(parts[1])
-		case "SMTP_USERNAME":
-			cfg.SMTPUsername = strings.TrimSpace(parts[1])
-		case "SMTP_PASSWORD":
-			cfg.SMTPPassword = strings.TrimSpace(parts[1])
-		case "ERMON_APP_NAME":
-			cfg.AppName = strings.TrimSpace(parts[1])
-		case "ERMON_MAIL_FROM":
-			cfg.MailFrom = strings.TrimSpace(parts[1])
-		case "ERMON_MAIL_TO":
-			cfg.MailTo = strings.TrimSpace(parts[1])
-		case "ERMON_MATCH_PATTERN":
-			matchPattern = strings.TrimSpace(parts[1])
-		case "ERMON_IGNORE_PATTERN":
-			ignorePattern = strings.TrimSpace(parts[1])
-		case "ERMON_MAX_EMAILS_PER_HOUR":
-			maxEmailsPerHour = strings.TrimSpace(parts[1])
-		}
-	}
-
-	// read environment variables after the config file
-	cfg.SMTPHost = eitherAorB(cfg.SMTPHost, os.Getenv("SMTP_HOST"))
-	cfg.SMTPPort = eitherAorB(cfg.SMTPPort, os.Getenv("SMTP_PORT"))
-	cfg.SMTPUsername = eitherAorB(cfg.SMTPUsername, os.Getenv("SMTP_USERNAME"))
-	cfg.SMTPPassword = eitherAorB(cfg.SMTPPassword, os.Getenv("SMTP_PASSWORD"))
-	cfg.AppName = eitherAorB(cfg.AppName, os.Getenv("ERMON_APP_NAME"))
-	cfg.MailFrom = eitherAorB(cfg.MailFrom, os.Getenv("ERMON_MAIL_FROM"))
-	cfg.MailTo = eitherAorB(cfg.MailTo, os.Getenv("ERMON_MAIL_TO"))
-	matchPattern = eitherAorB(matchPattern, os.Getenv("ERMON_MATCH_PATTERN"))
-	ignorePattern = eitherAorB(ignorePattern, os.Getenv("ERMON_IGNORE_PATTERN"))
-	maxEmailsPerHour = eitherAorB(maxEmailsPerHour, os.Getenv("ERMON_MAX_EMAILS_PER_HOUR"))
-
-	// validate all fields are present in the loop
-	for k, v := range map[string]string{
-		"SMTP_HOST":           cfg.SMTPHost,
-		"ERMON_MAIL_FROM":     cfg.MailFrom,
-		"ERMON_MAIL_TO":       cfg.MailTo,
-		"ERMON_APP_NAME":      cfg.AppName,
-		"ERMON_MATCH_PATTERN": matchPattern,
-	} {
-		if len(v) == 0 {
-			return nil, fmt.Errorf("missing required config value: %s", k)
+		cfgBody = os.Stdin
+	} else if body := os.Getenv("ERMON_CONFIG"); body != "" {
+		cfgBody = strings.NewReader(body)
+	}
+	// without the default .ermon, the config is read from the environment only,
+	// but a file that was passed explicitly must exist
+	noConfigFile := false
+	if len(cfgPaths) == 0 && cfgBody == nil {
+		if _, err := os.Stat(".ermon"); os.IsNotExist(err) {
+			noConfigFile = true
+		} else {
+			cfgPaths = []string{".ermon"}
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	var replayer *replayNotifier
+	if replayPath != "" {
+		// the alerts are only printed, so no channel has to be configured
+		replayer = &replayNotifier{out: os.Stdout, start: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+		customNotifiers = []registeredNotifier{{name: "replay", notifier: replayer}}
 	}
 
-	cfg.MaxEmailsPerHour = 5 // default
-	if maxEmailsPerHour != "" {
-		cfg.MaxEmailsPerHour, err = strconv.Atoi(maxEmailsPerHour)
-		if err != nil {
-			return cfg, fmt.Errorf("error converting ERMON_MAX_EMAILS_PER_HOUR to integer: %s", err)
+	config, err := parseConfig(cfgBody, cfgPaths)
+	if err != nil {
+		fmt.Println("[ermon] ", err)
+		if noConfigFile {
+			fmt.Println("[ermon] No .ermon config file found, pass the path to your config as an argument or set the values in the environment")
 		}
+		os.Exit(1)
 	}
+	verbosity = config.Verbosity
+	echoSample = config.EchoSample
 
-	if matchPattern != "" {
-		var err error
-		cfg.MatchPattern, err = regexp.Compile(matchPattern)
-		if err != nil {
-			return cfg, fmt.Errorf("error compiling ERMON_MATCH_PATTERN: %s", err)
-		}
+	if config.DesktopNotify && !desktopNotifySupported {
+		fmt.Println("[ermon] Desktop notifications are not supported on this OS, ERMON_NOTIFY is ignored")
 	}
 
-	if ignorePattern != "" {
-		var err error
-		cfg.IgnorePattern, err = regexp.Compile(ignorePattern)
-		if err != nil {
-			return cfg, fmt.Errorf("error compiling ERMON_IGNORE_PATTERN: %s", err)
-		}
+	if replayer != nil {
+		os.Exit(replay(*config, replayPath, replayer))
 	}
 
-	return cfg, nil
-}
+	if sendTest {
+		if !sendTestAlert(*config) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
-func eitherAorB(a, b string) string {
-	if a != "" {
-		return a
+	// files passed on the command line take precedence over ERMON_LOG_FILES
+	if len(logFiles) > 0 {
+		config.LogFiles = logFiles
 	}
-	return b
-}
 
-func main() {
-	var cfgPath = ".ermon"
-	if len(os.Args) > 1 {
-		cfgPath = os.Args[1]
+	defer recoverCrash(*config)
+	go func() {
+		defer recoverCrash(*config)
+		handleSignals()
+	}()
 
-		if cfgPath == "-h" || cfgPath == "--help" || cfgPath == "version" {
-			fmt.Println("ermon v" + version + " by Oleksandr Gornostal")
-			fmt.Println("\033[37mFor usage and configuration, see https://github.com/gornostal/ermon\033[0m")
-			os.Exit(0)
+	lines := make(chan LogLine, lineQueueSize)
+	exitCode := make(chan int, 1)
+	if len(command) > 0 {
+		go func() {
+			defer recoverCrash(*config)
+			exitCode <- runCommand(command, config.SourceLabel, splitLines(config.LineSplit), lines)
+		}()
+	} else if len(config.LogFiles) > 0 {
+		// following files never ends, ermon runs until it's stopped
+		for _, path := range config.LogFiles {
+			go func(path string) {
+				defer recoverCrash(*config)
+				followFile(path, lines)
+			}(path)
 		}
+	} else if config.JournalUnit != "" {
+		go func() {
+			defer recoverCrash(*config)
+			followJournal(config.JournalUnit, lines)
+		}()
+	} else {
+		go func() {
+			defer recoverCrash(*config)
+			readLogs(os.Stdin, config.SourceLabel, splitLines(config.LineSplit), lines)
+		}()
 	}
 
-	config, err := parseConfig(cfgPath)
-	if err != nil {
-		fmt.Println("[ermon] ", err)
-		os.Exit(1)
+	sent := make(chan struct{})
+	go sendEmails(*config, sent)
+
+	if config.HTTPAddr != "" {
+		go func() {
+			defer recoverCrash(*config)
+			serveHTTP(*config)
+		}()
+	}
+
+	stopPipeline := sync.OnceFunc(func() { close(shutdown) })
+	if config.MaxRuntime > 0 {
+		time.AfterFunc(config.MaxRuntime, func() {
+			logInfo("Reached ERMON_MAX_RUNTIME, shutting down")
+			stopPipeline()
+		})
+	}
+	// e.g. a container being stopped, the buffered errors are sent like at the end of the input
+	stopped, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-stopped.Done()
+		// another signal stops ermon right away
+		stopSignals()
+		logInfo("Received a stop signal, shutting down")
+		stopPipeline()
+	}()
+
+	var input <-chan LogLine = lines
+	if config.JSONMultiline {
+		input = joinJSONLines(*config, input)
+	}
+	if config.MatchWorkers > 1 {
+		input = matchInParallel(*config, input, config.MatchWorkers)
 	}
 
-	go watchLogBuffer(*config)
+	runPipeline(*config, input)
+
+	logInfo(fmt.Sprintf("Processed %d lines: %d error(s), %d ignored", stats.lines, stats.errors, stats.ignored))
+
+	// wait for the last emails to be sent
+	close(outbox)
+	waitForSending(*config, sent)
 
-	readLogs(*config, os.Stdin)
+	if len(command) > 0 {
+		// exit like the command did, so supervisors see its failures
+		select {
+		case code := <-exitCode:
+			if code != 0 {
+				os.Exit(code)
+			}
+		default:
+			// stopped by ERMON_MAX_RUNTIME or a signal before the command exited
+		}
+	}
 
-	finalRun = true
-	sendLogsByEmail(*config)
+	if config.FailOnAlert && stats.alerts > 0 {
+		os.Exit(exitCodeAlerted)
+	}
 }
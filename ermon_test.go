@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// only the config of the test is used, not the one of the machine
+	for _, v := range os.Environ() {
+		key, _, _ := strings.Cut(v, "=")
+		for _, prefix := range []string{"ERMON_", "SMTP_", "SLACK_", "DISCORD_", "GITHUB_"} {
+			if strings.HasPrefix(key, prefix) {
+				os.Unsetenv(key)
+			}
+		}
+	}
+	time.Local = time.UTC
+	verbosity = verbosityQuiet
+	os.Exit(m.Run())
+}
+
+// resetState puts the pipeline back into the state it has when ermon starts, the tests share its globals
+func resetState() {
+	now = time.Now
+	startupTime = now()
+	debug = false
+	emailsSent = nil
+	finalRun = false
+	inputFailed = false
+	timeSinceError = time.Time{}
+	emailBuffer = nil
+	logBuffer = nil
+	lastErrorLineIndex = 0
+	lineNumber = 0
+	maintenanceActive = false
+	suppressedErrorCount = 0
+	consecutiveErrors = 0
+	consecutiveStart = time.Time{}
+	consecutiveThresholdReached = false
+	errorTimes = nil
+	successTimes = nil
+	lowRateReported = false
+	rateThresholdReached = false
+	incidentAlerted = false
+	incidentThread = ""
+	incidentLastCount = 0
+	incidentSentLines = nil
+	lastErrorAt = time.Time{}
+	sendContext, cancelSending = context.WithCancel(context.Background())
+	recoveryPendingSince = time.Time{}
+	burstStart = time.Time{}
+	ignoredSinceLastEmail = 0
+	inIgnoredBlock = false
+	sampledOutSinceLastEmail = 0
+	sampleCounts = map[string]int{}
+	stats.lines, stats.errors, stats.ignored, stats.alerts = 0, 0, 0, 0
+	runningContextBuffer = [maxContextBuffer]LogLine{}
+	highlightBuffer = nil
+	historyBuffer = nil
+	historyInLogBuffer = 0
+	lastThread = ""
+	batchThread = ""
+	shutdown = make(chan struct{})
+	outbox = make(chan email, maxEmailBufferSize)
+	sending = nil
+	ruleMatchTimes = map[string][]time.Time{}
+	lastAlert = nil
+	customNotifiers = nil
+	verbosity = verbosityQuiet
+}
+
+// fakeNotifier keeps the alerts instead of sending them
+type fakeNotifier struct {
+	mutex  sync.Mutex
+	alerts []Alert
+}
+
+func (n *fakeNotifier) Notify(ctx context.Context, a Alert) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.alerts = append(n.alerts, a)
+	return nil
+}
+
+func (n *fakeNotifier) sent() []Alert {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return append([]Alert(nil), n.alerts...)
+}
+
+// testConfig parses the config of a test, with the fake notifier as its only channel
+func testConfig(t testing.TB, notifier Notifier, config string) Config {
+	t.Helper()
+	resetState()
+	customNotifiers = []registeredNotifier{{name: "fake", notifier: notifier}}
+	cfg, err := parseConfig(strings.NewReader("ERMON_APP_NAME=test\n"+config), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *cfg
+}
+
+// TestPipelineConcurrency feeds the pipeline from several readers while the alerts are sent and flushes are
+// requested, run it with -race
+func TestPipelineConcurrency(t *testing.T) {
+	const readers, linesPerReader = 4, 300
+	for _, workers := range []string{"1", "4"} {
+		t.Run("workers="+workers, func(t *testing.T) {
+			notifier := &fakeNotifier{}
+			cfg := testConfig(t, notifier, "ERMON_MATCH_PATTERN=ERROR\nERMON_ERROR_WINDOW=10ms\nERMON_OVERFLOW=block\n"+
+				"ERMON_MAX_EMAILS_PER_HOUR=100000\nERMON_MATCH_WORKERS="+workers+"\n")
+			debug = true // no crash grace period for the final alert
+
+			sent := make(chan struct{})
+			go sendEmails(cfg, sent)
+
+			lines := make(chan LogLine, lineQueueSize)
+			var input <-chan LogLine = lines
+			if cfg.MatchWorkers > 1 {
+				input = matchInParallel(cfg, lines, cfg.MatchWorkers)
+			}
+			var wg sync.WaitGroup
+			errors := 0
+			for r := 0; r < readers; r++ {
+				var log strings.Builder
+				for i := 0; i < linesPerReader; i++ {
+					if i%10 == 0 {
+						fmt.Fprintf(&log, "ERROR reader %d failed at line %d\n", r, i)
+						errors++
+					} else {
+						fmt.Fprintf(&log, "INFO reader %d is at line %d\n", r, i)
+					}
+				}
+				wg.Add(1)
+				go func(r int, log string) {
+					defer wg.Done()
+					readStream(strings.NewReader(log), fmt.Sprintf("reader-%d", r), "", io.Discard, splitLines(""), lines)
+				}(r, log.String())
+			}
+			flushing := make(chan struct{})
+			go func() {
+				for {
+					select {
+					case <-flushing:
+						return
+					case <-time.After(time.Millisecond):
+						requestFlush()
+					}
+				}
+			}()
+			go func() {
+				wg.Wait()
+				close(lines)
+			}()
+
+			runPipeline(cfg, input)
+			close(flushing)
+			close(outbox)
+			<-sent
+
+			count := 0
+			for _, a := range notifier.sent() {
+				count += a.Count
+			}
+			if count != errors {
+				t.Errorf("%d errors were alerted, want %d", count, errors)
+			}
+		})
+	}
+}
+
+func TestMailHeaderInjection(t *testing.T) {
+	cfg := testConfig(t, &fakeNotifier{}, "ERMON_MATCH_PATTERN=ERROR\n")
+	cfg.AppName = "shop\r\nBcc: attacker@example.com"
+	cfg.MailFrom = "ermon@example.com\r\nBcc: attacker@example.com"
+	cfg.MailTo = "ops@example.com\nBcc: attacker@example.com"
+
+	message := mailMessage(cfg, email{id: "test", text: "ERROR db down\n", errorCount: 1, time: now()})
+	m, err := mail.ReadMessage(strings.NewReader(string(message)))
+	if err != nil {
+		t.Fatalf("the message can't be parsed: %v\n%s", err, message)
+	}
+	if bcc := m.Header.Get("Bcc"); bcc != "" {
+		t.Errorf("a Bcc header was injected: %q", bcc)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil || !strings.Contains(subject, "shop") || !strings.Contains(subject, "Bcc: attacker@example.com") {
+		t.Errorf("the app name isn't kept in the subject: %q, %v", subject, err)
+	}
+	for _, header := range []string{"From", "To", "Message-Id"} {
+		if strings.ContainsAny(m.Header.Get(header), "\r\n") {
+			t.Errorf("the %s header contains a line break: %q", header, m.Header.Get(header))
+		}
+	}
+}
+
+func TestEmailOutput(t *testing.T) {
+	cfg := testConfig(t, &fakeNotifier{}, "ERMON_MATCH_PATTERN=ERROR\n")
+	debug = true
+	for _, text := range []string{"INFO start", "ERROR db <down> & out", "INFO retry"} {
+		processLine(cfg, LogLine{Text: text, Time: now()})
+	}
+	sendLogsByEmail(cfg, true)
+	e := <-outbox
+
+	if subject, want := emailSubject(cfg, e), "[Alert] test reported 1 error(s) #"+e.id; subject != want {
+		t.Errorf("subject = %q, want %q", subject, want)
+	}
+	wantErrors := "INFO start\n<span style=\"color: black\">ERROR db &lt;down&gt; &amp; out</span>\nINFO retry\n"
+	if e.errors != wantErrors {
+		t.Errorf("the log lines are rendered as %q, want %q", e.errors, wantErrors)
+	}
+	if e.text != "INFO start\nERROR db <down> & out\nINFO retry\n" {
+		t.Errorf("the plain text is %q", e.text)
+	}
+	body := emailBody(cfg, e)
+	if !strings.Contains(body, wantErrors) {
+		t.Errorf("the log lines are missing from the body:\n%s", body)
+	}
+	for _, placeholder := range []string{"{date}", "{id}", "{trigger}", "{header}", "{footer}", "{errors}"} {
+		if strings.Contains(body, placeholder) {
+			t.Errorf("%s is left in the body", placeholder)
+		}
+	}
+}
+
+// fakeClock makes now() return the time set by the test
+func fakeClock() *time.Time {
+	clock := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	startupTime = clock
+	return &clock
+}
+
+// drainOutbox returns the number of the composed emails
+func drainOutbox() int {
+	n := 0
+	for len(outbox) > 0 {
+		<-outbox
+		n++
+	}
+	return n
+}
+
+func TestErrorWindow(t *testing.T) {
+	cfg := testConfig(t, &fakeNotifier{}, "ERMON_MATCH_PATTERN=ERROR\nERMON_ERROR_WINDOW=1m\n")
+	clock := fakeClock()
+
+	processLine(cfg, LogLine{Text: "ERROR db down", Time: now()})
+	*clock = clock.Add(30 * time.Second)
+	processLine(cfg, LogLine{Text: "ERROR db still down", Time: now()})
+	*clock = clock.Add(59 * time.Second)
+	sendLogsByEmail(cfg, false)
+	if n := drainOutbox(); n != 0 {
+		t.Fatalf("%d email(s) were sent within the error window", n)
+	}
+
+	// the window starts at the last error
+	*clock = clock.Add(2 * time.Second)
+	sendLogsByEmail(cfg, false)
+	if n := drainOutbox(); n != 1 {
+		t.Fatalf("%d email(s) were sent after the error window, want 1", n)
+	}
+}
+
+func TestMaxEmailsPerHour(t *testing.T) {
+	cfg := testConfig(t, &fakeNotifier{}, "ERMON_MATCH_PATTERN=ERROR\nERMON_ERROR_WINDOW=1m\nERMON_MAX_EMAILS_PER_HOUR=2\n")
+	clock := fakeClock()
+	start := *clock
+
+	sent := 0
+	for i := 0; i < 4; i++ {
+		processLine(cfg, LogLine{Text: fmt.Sprintf("ERROR db down %d", i), Time: now()})
+		*clock = clock.Add(2 * time.Minute)
+		sendLogsByEmail(cfg, false)
+		sent += drainOutbox()
+	}
+	if sent != 2 {
+		t.Fatalf("%d emails were sent in the first hour, want 2", sent)
+	}
+
+	// the first email no longer counts an hour after it was sent
+	*clock = start.Add(time.Hour + 3*time.Minute)
+	processLine(cfg, LogLine{Text: "ERROR db down again", Time: now()})
+	*clock = clock.Add(2 * time.Minute)
+	sendLogsByEmail(cfg, false)
+	if n := drainOutbox(); n != 1 {
+		t.Fatalf("%d email(s) were sent an hour later, want 1", n)
+	}
+}
+
+func TestFlushThreshold(t *testing.T) {
+	for _, threshold := range []int{maxContextBuffer * 2, defaultFlushThresholdLines, 100} {
+		t.Run(fmt.Sprint(threshold), func(t *testing.T) {
+			cfg := testConfig(t, &fakeNotifier{}, fmt.Sprintf("ERMON_MATCH_PATTERN=ERROR\nERMON_FLUSH_THRESHOLD_LINES=%d\n", threshold))
+			for i := 0; i < maxContextBuffer; i++ {
+				processLine(cfg, LogLine{Text: fmt.Sprintf("INFO line %d", i), Time: now()})
+			}
+			// the errors keep the batch open, it's closed by the line after it gets more lines than the threshold
+			for i := 0; len(emailBuffer) == 0; i++ {
+				if len(logBuffer) > threshold+1 {
+					t.Fatalf("the batch has %d lines and isn't closed", len(logBuffer))
+				}
+				processLine(cfg, LogLine{Text: fmt.Sprintf("ERROR line %d", i), Time: now()})
+			}
+			if len(emailBuffer[0]) != threshold+1 {
+				t.Errorf("the batch is closed with %d lines, want %d", len(emailBuffer[0]), threshold+1)
+			}
+		})
+	}
+}
+
+func TestBatchClosedAfterContext(t *testing.T) {
+	cfg := testConfig(t, &fakeNotifier{}, "ERMON_MATCH_PATTERN=ERROR\n")
+	processLine(cfg, LogLine{Text: "ERROR db down", Time: now()})
+	for i := 1; i <= maxContextBuffer; i++ {
+		if len(emailBuffer) != 0 {
+			t.Fatalf("the batch is closed %d line(s) after the error", i-1)
+		}
+		processLine(cfg, LogLine{Text: fmt.Sprintf("INFO line %d", i), Time: now()})
+	}
+	if len(emailBuffer) != 1 {
+		t.Fatalf("the batch isn't closed %d lines after the error", maxContextBuffer)
+	}
+}
+
+// benchmarkConfig has a few patterns that are slow enough to make the matching dominate
+const benchmarkConfig = "ERMON_MATCH_PATTERN=(?i)(error|fatal|panic|exception|timed? ?out)\\b.*(db|cache|queue|payment)\n" +
+	"ERMON_IGNORE_PATTERN=(?i)deprecat(ed|ion)\n"
+
+// benchmarkLine returns a log line, every 50th line is an error
+func benchmarkLine(i int) LogLine {
+	if i%50 == 0 {
+		return LogLine{Text: fmt.Sprintf("2024-01-01 12:00:00 ERROR request %d failed: db connection reset by peer", i), Time: now()}
+	}
+	return LogLine{Text: fmt.Sprintf("2024-01-01 12:00:00 INFO request %d served in 12ms by worker 7 of the web pool", i), Time: now()}
+}
+
+func BenchmarkProcessLine(b *testing.B) {
+	cfg := testConfig(b, &fakeNotifier{}, benchmarkConfig)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		processLine(cfg, benchmarkLine(i))
+		if len(emailBuffer) >= maxEmailBufferSize {
+			// the batches are sent in the real pipeline, keep the lines from being dropped
+			emailBuffer = nil
+		}
+	}
+}
+
+// BenchmarkMatchWorkers compares matching the lines on the pipeline goroutine with ERMON_MATCH_WORKERS
+func BenchmarkMatchWorkers(b *testing.B) {
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprint("workers=", workers), func(b *testing.B) {
+			cfg := testConfig(b, &fakeNotifier{}, benchmarkConfig)
+			lines := make(chan LogLine, lineQueueSize)
+			var input <-chan LogLine = lines
+			if workers > 1 {
+				input = matchInParallel(cfg, lines, workers)
+			}
+			b.ResetTimer()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					lines <- benchmarkLine(i)
+				}
+				close(lines)
+			}()
+			for line := range input {
+				processLine(cfg, line)
+				if len(emailBuffer) >= maxEmailBufferSize {
+					emailBuffer = nil
+				}
+			}
+		})
+	}
+}
+
+func TestConsecutiveThreshold(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		lines  []string
+		alerts int
+	}{
+		{"in a row", "", []string{"ERROR 1", "ERROR 2", "ERROR 3"}, 1},
+		{"other line in between", "", []string{"ERROR 1", "ERROR 2", "INFO retried", "ERROR 3"}, 0},
+		{"reset line in between", "ERMON_RESET_PATTERN=recovered\n", []string{"ERROR 1", "recovered", "ERROR 2", "ERROR 3"}, 0},
+		{"stack trace with a success pattern", "ERMON_SUCCESS_PATTERN=request served\nERMON_EXPECT_RATE=1\n", []string{"ERROR 1", "  at main.go:12", "ERROR 2", "ERROR 3"}, 1},
+		{"success line in between", "ERMON_SUCCESS_PATTERN=request served\nERMON_EXPECT_RATE=1\n", []string{"ERROR 1", "ERROR 2", "request served", "ERROR 3"}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig(t, &fakeNotifier{}, "ERMON_MATCH_PATTERN=ERROR\nERMON_ERROR_WINDOW=1m\n"+
+				"ERMON_CONSECUTIVE_THRESHOLD=3\nERMON_CONSECUTIVE_WINDOW=5m\n"+test.config)
+			clock := fakeClock()
+			for _, text := range test.lines {
+				processLine(cfg, LogLine{Text: text, Time: now()})
+				*clock = clock.Add(time.Second)
+			}
+			*clock = clock.Add(10 * time.Minute)
+			sendLogsByEmail(cfg, false)
+			if n := drainOutbox(); n != test.alerts {
+				t.Errorf("%d alert(s) were sent, want %d", n, test.alerts)
+			}
+		})
+	}
+}
+
+func TestBlockOnOverflowKeepsLines(t *testing.T) {
+	cfg := testConfig(t, &fakeNotifier{}, "ERMON_MATCH_PATTERN=ERROR\nERMON_OVERFLOW=block\nERMON_FLUSH_THRESHOLD_LINES=16\n")
+	// fill the emailBuffer up to the last batch, like the pipeline does before it stops reading
+	for len(emailBuffer) < maxEmailBufferSize-1 {
+		emailBuffer = append(emailBuffer, []LogLine{{Text: "ERROR earlier", Matched: true}})
+	}
+	errors := 0
+	for i := 0; len(emailBuffer) < maxEmailBufferSize; i++ {
+		processLine(cfg, LogLine{Text: fmt.Sprintf("ERROR line %d", i), Time: now()})
+		errors++
+	}
+
+	found := map[string]bool{}
+	for _, buf := range append(emailBuffer, logBuffer) {
+		for _, line := range buf {
+			found[line.Text] = true
+		}
+	}
+	for i := 0; i < errors; i++ {
+		if text := fmt.Sprintf("ERROR line %d", i); !found[text] {
+			t.Errorf("%q was lost when the batch filled the emailBuffer", text)
+		}
+	}
+}
+
+func TestLastEmailOfTheHourWithFullBuffer(t *testing.T) {
+	for _, overflow := range []string{"drop", "block"} {
+		t.Run(overflow, func(t *testing.T) {
+			cfg := testConfig(t, &fakeNotifier{}, "ERMON_MATCH_PATTERN=ERROR\nERMON_WARNING_PATTERN=WARN\nERMON_MAX_EMAILS_PER_HOUR=4\nERMON_OVERFLOW="+overflow+"\n")
+			emailsSent = []time.Time{now(), now(), now()}
+			for i := 0; i < maxEmailBufferSize; i++ {
+				emailBuffer = append(emailBuffer, []LogLine{{Text: fmt.Sprintf("WARN %d", i), Matched: true, Severity: severityWarning}})
+			}
+			sendLogsByEmail(cfg, false)
+
+			want := maxEmailBufferSize
+			if overflow == "drop" {
+				// room is left for a batch with errors
+				want--
+			}
+			if len(emailBuffer) != want || drainOutbox() != 0 {
+				t.Errorf("%d warning batch(es) are kept, want %d", len(emailBuffer), want)
+			}
+		})
+	}
+}
+
+func TestLineNumbersOfTwoSources(t *testing.T) {
+	cfg := testConfig(t, &fakeNotifier{}, "ERMON_MATCH_PATTERN=ERROR\nERMON_SHOW_LINE_NUMBERS=true\nERMON_SHOW_SOURCE=true\n")
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(path, []byte("INFO a\nINFO b\nINFO c\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileLines := make(chan LogLine, 10)
+	go followFile(path, fileLines)
+	time.Sleep(100 * time.Millisecond) // followFile is at the end of the file
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("ERROR in the file\n")
+	file.Close()
+
+	stdinLines := make(chan LogLine, 10)
+	readLogs(strings.NewReader("INFO x\nERROR on stdin\n"), "stdin", splitLines(""), stdinLines)
+	processLine(cfg, <-stdinLines)
+	select {
+	case line := <-fileLines:
+		processLine(cfg, line)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the appended line wasn't read")
+	}
+	processLine(cfg, <-stdinLines)
+
+	sendLogsByEmail(cfg, true)
+	e := <-outbox
+	for _, want := range []string{"[app.log] 4: ERROR in the file\n", "[stdin] 2: ERROR on stdin\n"} {
+		if !strings.Contains(e.text, want) {
+			t.Errorf("%q is missing from the alert:\n%s", want, e.text)
+		}
+	}
+}
+
+// recordingServer keeps the emails the demo reads from its fake SMTP server
+type recordingServer struct {
+	*fakeSMTPServer
+	received []string
+}
+
+func (s *recordingServer) Messages() <-chan string {
+	messages := make(chan string, maxEmailBufferSize)
+	for len(s.fakeSMTPServer.messages) > 0 {
+		message := <-s.fakeSMTPServer.messages
+		s.received = append(s.received, message)
+		messages <- message
+	}
+	return messages
+}
+
+func TestDemo(t *testing.T) {
+	resetState()
+	smtpServer, err := startFakeSMTPServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer smtpServer.Close()
+	server := &recordingServer{fakeSMTPServer: smtpServer}
+
+	if code := demo(server); code != 0 {
+		t.Fatalf("the demo exited with %d", code)
+	}
+	if len(server.received) != 1 {
+		t.Fatalf("the fake SMTP server received %d emails, want 1", len(server.received))
+	}
+	for _, want := range []string{"Subject:", "Failed to charge the card of order 43", "payment gateway timed out", "PaymentClient.java:87"} {
+		if !strings.Contains(server.received[0], want) {
+			t.Errorf("%q is missing from the email:\n%s", want, server.received[0])
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// escalation posts the batches of a rule to another webhook, e.g. to page someone,
+// once the rule matches more than threshold lines within the window
+type escalation struct {
+	threshold int
+	window    time.Duration
+	url       string
+}
+
+func hasEscalations(cfg Config) bool {
+	for _, r := range cfg.Rules {
+		if r.escalation != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleMatchTimes are the times of the recent matches of the rules that have an escalation
+var ruleMatchTimes = map[string][]time.Time{}
+
+// recordRuleMatch remembers the time of the matched line and forgets the ones outside of the escalation window
+func recordRuleMatch(cfg Config, line LogLine) {
+	for _, r := range cfg.Rules {
+		if r.name != line.Rule || r.escalation == nil {
+			continue
+		}
+		times := append(ruleMatchTimes[r.name], line.Time)
+		for len(times) > 0 && line.Time.Sub(times[0]) > r.escalation.window {
+			times = times[1:]
+		}
+		ruleMatchTimes[r.name] = times
+		return
+	}
+}
+
+// escalatedRules returns the rules of the alert that matched more lines than their escalation threshold
+func escalatedRules(cfg Config, rules []string) []string {
+	var escalated []string
+	for _, r := range cfg.Rules {
+		if r.escalation == nil || !contains(rules, r.name) || contains(escalated, r.name) {
+			continue
+		}
+		count := 0
+		for _, t := range ruleMatchTimes[r.name] {
+			if now().Sub(t) <= r.escalation.window {
+				count++
+			}
+		}
+		if count > r.escalation.threshold {
+			escalated = append(escalated, r.name)
+		}
+	}
+	return escalated
+}
+
+// sendEscalations posts the batches of the escalated rules to their ERMON_RULE_ESCALATIONS webhooks,
+// rendered with ERMON_WEBHOOK_TEMPLATE. Test alerts go to all of them.
+func sendEscalations(ctx context.Context, cfg Config, e email) error {
+	var urls []string
+	rulesByURL := map[string][]string{}
+	for _, r := range cfg.Rules {
+		if r.escalation == nil || !(e.test || contains(e.escalations, r.name)) {
+			continue
+		}
+		if !contains(urls, r.escalation.url) {
+			urls = append(urls, r.escalation.url)
+		}
+		rulesByURL[r.escalation.url] = append(rulesByURL[r.escalation.url], r.name)
+	}
+
+	var failed []string
+	for _, url := range urls {
+		escalated := e
+		if !e.test && len(e.batches) > 0 {
+			// only the batches of the escalated rules
+			escalated = email{id: e.id, title: e.title, time: e.time}
+			for _, batch := range e.batches {
+				if !containsAny(batch.rules, rulesByURL[url]) {
+					continue
+				}
+				if escalated.text != "" {
+					escalated.text += "…\n"
+				}
+				escalated.text += batch.text
+				escalated.batches = append(escalated.batches, batch)
+				escalated.errorCount += batch.errorCount
+				escalated.severity = max(escalated.severity, batch.severity)
+				for _, name := range batch.rules {
+					if !contains(escalated.rules, name) {
+						escalated.rules = append(escalated.rules, name)
+					}
+				}
+			}
+		}
+		if err := postWebhook(ctx, cfg, url, escalated); err != nil {
+			failed = append(failed, url+": "+err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func containsAny(values []string, wanted []string) bool {
+	for _, w := range wanted {
+		if contains(values, w) {
+			return true
+		}
+	}
+	return false
+}
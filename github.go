@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const defaultGitHubAPIURL = "https://api.github.com"
+const maxGitHubBodyLength = 65536 // GitHub's limit for issue and comment bodies
+
+type githubIssue struct {
+	Number int    `json:"number"`
+	Title  string `json:"title"`
+}
+
+// sendGitHubIssue opens an issue in GITHUB_REPO titled with the first error line.
+// If an open issue with the same title and ERMON_GITHUB_LABEL exists, the alert is added to it as a comment instead.
+// Recovery notices are not reported.
+func sendGitHubIssue(ctx context.Context, cfg Config, e email) error {
+	if e.recovered {
+		// the issues are closed by people, a recovery doesn't mean the cause is fixed
+		return nil
+	}
+	title := e.title
+	if title == "" || e.test || e.crash {
+		title = emailSubject(cfg, email{test: e.test, crash: e.crash, title: e.title, errorCount: e.errorCount, rules: e.rules})
+	}
+	body := renderMarkdown(e, commonMarkdown, maxGitHubBodyLength-100) + "\n\nReported by ermon, alert " + e.id
+
+	var open []githubIssue
+	query := url.Values{"state": {"open"}, "labels": {cfg.GitHubLabel}, "per_page": {"100"}}
+	if err := githubRequest(ctx, cfg, http.MethodGet, "/issues?"+query.Encode(), nil, &open); err != nil {
+		return err
+	}
+	for _, issue := range open {
+		if issue.Title == title {
+			return githubRequest(ctx, cfg, http.MethodPost, "/issues/"+strconv.Itoa(issue.Number)+"/comments",
+				map[string]interface{}{"body": body}, nil)
+		}
+	}
+
+	return githubRequest(ctx, cfg, http.MethodPost, "/issues",
+		map[string]interface{}{"title": title, "body": body, "labels": []string{cfg.GitHubLabel}}, nil)
+}
+
+// githubRequest calls the API of GITHUB_REPO and decodes the response into out, if it's not nil
+func githubRequest(ctx context.Context, cfg Config, method string, path string, payload interface{}, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(cfg.GitHubAPIURL, "/")+"/repos/"+cfg.GitHubRepo+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.GitHubToken)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
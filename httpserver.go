@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"sync"
+)
+
+// lastAlert is the most recent alert taken from the outbox, served at /last-alert
+var lastAlert *email
+var lastAlertMutex sync.Mutex
+
+func setLastAlert(e email) {
+	if e.test {
+		return
+	}
+	lastAlertMutex.Lock()
+	defer lastAlertMutex.Unlock()
+	lastAlert = &e
+}
+
+// serveHTTP listens on ERMON_HTTP_ADDR, /last-alert shows the HTML of the most recent alert,
+// so it can be checked in a browser without waiting for the email
+func serveHTTP(cfg Config) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/last-alert", func(w http.ResponseWriter, r *http.Request) {
+		lastAlertMutex.Lock()
+		e := lastAlert
+		lastAlertMutex.Unlock()
+
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if e == nil {
+			fmt.Fprintf(w, "<html><body><p>%s: no alerts since ermon started at %s</p></body></html>\n",
+				html.EscapeString(cfg.AppName), html.EscapeString(formatTime(cfg, startupTime)))
+			return
+		}
+		w.Header().Set("Last-Modified", e.time.UTC().Format(http.TimeFormat))
+		fmt.Fprint(w, emailBody(cfg, *e))
+	})
+
+	logInfo("Serving the last alert at http://" + cfg.HTTPAddr + "/last-alert")
+	if err := http.ListenAndServe(cfg.HTTPAddr, mux); err != nil {
+		logError("Error starting the HTTP server:", err)
+	}
+}
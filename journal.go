@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const journalRestartDelay = time.Second * 5
+const maxJournalEntrySize = 1024 * 1024
+
+// journalEntry holds the fields of a journalctl -o json entry that ermon uses
+type journalEntry struct {
+	Cursor   string          `json:"__CURSOR"`
+	Realtime string          `json:"__REALTIME_TIMESTAMP"` // microseconds since the epoch
+	Message  json.RawMessage `json:"MESSAGE"`              // a string, or an array of bytes if it's not valid UTF-8
+	Unit     string          `json:"_SYSTEMD_UNIT"`
+}
+
+// followJournal reads the new entries of the systemd unit with journalctl, similar to journalctl -u unit -f.
+// If journalctl exits, e.g. because the journal files were rotated or vacuumed, it's restarted after the last entry read.
+func followJournal(unit string, lines chan<- LogLine) {
+	// only the entries written since ermon started, older ones were handled by the previous run
+	args := []string{"-u", unit, "-f", "-o", "json", "--since", "@" + strconv.FormatInt(startupTime.Unix(), 10)}
+	for {
+		cursor, err := readJournal(args, unit, lines)
+		if err != nil {
+			logError("journalctl:", err)
+		}
+		logInfo("journalctl exited, restarting in", journalRestartDelay)
+		time.Sleep(journalRestartDelay)
+		if cursor != "" {
+			args = []string{"-u", unit, "-f", "-o", "json", "--after-cursor", cursor}
+		}
+	}
+}
+
+// readJournal runs journalctl until it exits and returns the cursor of the last entry
+func readJournal(args []string, unit string, lines chan<- LogLine) (cursor string, err error) {
+	cmd := exec.Command("journalctl", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxJournalEntrySize)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		cursor = entry.Cursor
+
+		line := LogLine{Text: journalMessage(entry.Message), Time: now(), Source: eitherAorB(entry.Unit, unit)}
+		if us, err := strconv.ParseInt(entry.Realtime, 10, 64); err == nil {
+			line.Time = time.UnixMicro(us)
+		}
+		echoLine(os.Stdout, line.Text)
+		lines <- line
+	}
+	if err := scanner.Err(); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return cursor, err
+	}
+	return cursor, cmd.Wait()
+}
+
+// journalMessage decodes the MESSAGE field, which journalctl renders as an array of bytes if it's not valid UTF-8
+func journalMessage(raw json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+	var data []byte
+	var bytes []int
+	if err := json.Unmarshal(raw, &bytes); err == nil {
+		for _, b := range bytes {
+			data = append(data, byte(b))
+		}
+	}
+	return string(data)
+}
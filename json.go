@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+const defaultJSONMaxLines = 200
+
+// jsonObject is a pretty-printed JSON object that is being read line by line
+type jsonObject struct {
+	source string
+	stream string
+	lines  []LogLine
+	depth  int  // the number of unclosed braces and brackets
+	quoted bool // whether the last line ended inside a string
+}
+
+// joinJSONLines joins the lines of pretty-printed JSON objects into single lines, so the patterns match the whole object.
+// An object starts with a line beginning with {, and ends when its braces are balanced. If it's not closed within
+// ERMON_JSON_MAX_LINES lines, its lines are passed on one by one. Lines of different sources and streams
+// are joined separately, so the stdout and stderr of a command don't get mixed up.
+func joinJSONLines(cfg Config, lines <-chan LogLine) <-chan LogLine {
+	out := make(chan LogLine, lineQueueSize)
+
+	go func() {
+		defer recoverCrash(cfg)
+		var pending []*jsonObject
+
+		for line := range lines {
+			var obj *jsonObject
+			i := 0
+			for ; i < len(pending); i++ {
+				if pending[i].source == line.Source && pending[i].stream == line.Stream {
+					obj = pending[i]
+					break
+				}
+			}
+
+			if obj == nil {
+				if !strings.HasPrefix(strings.TrimSpace(line.Text), "{") {
+					out <- line
+					continue
+				}
+				obj = &jsonObject{source: line.Source, stream: line.Stream}
+				if obj.add(line); obj.depth <= 0 {
+					// a single-line object
+					out <- line
+					continue
+				}
+				pending = append(pending, obj)
+				continue
+			}
+
+			obj.add(line)
+			if obj.depth > 0 && len(obj.lines) < cfg.JSONMaxLines {
+				continue
+			}
+			pending = append(pending[:i], pending[i+1:]...)
+			if obj.depth > 0 {
+				// never closed, most likely not JSON after all
+				for _, l := range obj.lines {
+					out <- l
+				}
+				continue
+			}
+			out <- obj.join()
+		}
+
+		// the input ended in the middle of the objects
+		for _, obj := range pending {
+			for _, l := range obj.lines {
+				out <- l
+			}
+		}
+		close(out)
+	}()
+
+	return out
+}
+
+// add appends the line to the object and counts the braces and brackets outside of the strings
+func (o *jsonObject) add(line LogLine) {
+	o.lines = append(o.lines, line)
+	escaped := false
+	for _, c := range line.Text {
+		switch {
+		case escaped:
+			escaped = false
+		case o.quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			o.quoted = !o.quoted
+		case o.quoted:
+		case c == '{' || c == '[':
+			o.depth++
+		case c == '}' || c == ']':
+			o.depth--
+		}
+	}
+}
+
+// join returns the object as a single line, compacted if it's valid JSON, with the time and the source of its first line
+func (o *jsonObject) join() LogLine {
+	texts := make([]string, len(o.lines))
+	for i, l := range o.lines {
+		texts[i] = strings.TrimSpace(l.Text)
+	}
+	line := o.lines[0]
+	line.Text = strings.Join(texts, " ")
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(line.Text)); err == nil {
+		line.Text = compact.String()
+	}
+	return line
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const kafkaClientID = "ermon"
+const kafkaProduceTimeout = time.Second * 10
+const maxKafkaResponseSize = 16 * 1024 * 1024
+
+// the API keys and versions of the requests, the versions are the oldest ones that the current brokers accept
+const (
+	kafkaProduceAPI      = 0
+	kafkaProduceVersion  = 3 // the first version with the v2 record batches
+	kafkaMetadataAPI     = 3
+	kafkaMetadataVersion = 4
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaErrors are the error codes of the responses that are most likely to happen when producing
+var kafkaErrors = map[int16]string{
+	3:  "the topic doesn't exist",
+	5:  "the partition has no leader",
+	6:  "the broker is not the leader of the partition",
+	7:  "the request timed out",
+	10: "the message is too large",
+	19: "not enough replicas",
+	29: "not authorized to access the topic",
+}
+
+// kafkaProducer produces every alert as a JSON message to ERMON_KAFKA_TOPIC, the same object that is written to ERMON_SOCKET.
+// It speaks just enough of the Kafka protocol for that, without TLS and SASL: it asks ERMON_KAFKA_BROKERS which broker leads
+// the partition of the app and sends the messages to that broker until it fails, then the leader is looked up again.
+// Like the other channels, the failed alerts are retried from ERMON_SPOOL_DIR.
+type kafkaProducer struct {
+	cfg       Config
+	mutex     sync.Mutex
+	leader    string // address of the leader of the partition, empty until it's looked up
+	partition int32
+}
+
+func newKafkaProducer(cfg Config) *kafkaProducer {
+	return &kafkaProducer{cfg: cfg}
+}
+
+func (p *kafkaProducer) Notify(ctx context.Context, a Alert) error {
+	value, err := alertJSON(p.cfg, a.email)
+	if err != nil {
+		return err
+	}
+	// the alerts of an app go to the same partition, so they are consumed in order
+	key := []byte(a.App)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.leader == "" {
+		if p.leader, p.partition, err = p.findLeader(ctx, key); err != nil {
+			return err
+		}
+	}
+	if err := p.produce(ctx, key, value, a.Time); err != nil {
+		// the leadership may have moved to another broker
+		p.leader = ""
+		return err
+	}
+	return nil
+}
+
+// findLeader asks the brokers for the metadata of the topic, until one of them answers
+func (p *kafkaProducer) findLeader(ctx context.Context, key []byte) (string, int32, error) {
+	var body []byte
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = appendKafkaString(body, p.cfg.KafkaTopic)
+	body = append(body, 0) // don't create the topic
+
+	var lastErr error
+	for _, broker := range p.cfg.KafkaBrokers {
+		resp, err := kafkaRoundTrip(ctx, broker, kafkaMetadataAPI, kafkaMetadataVersion, body)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %s", broker, err)
+			continue
+		}
+		return p.parseMetadata(resp, key)
+	}
+	return "", 0, lastErr
+}
+
+func (p *kafkaProducer) parseMetadata(resp []byte, key []byte) (string, int32, error) {
+	r := &kafkaReader{data: resp}
+	r.int32() // throttle time
+	brokers := map[int32]string{}
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		id, host, port := r.int32(), r.string(), r.int32()
+		r.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.string() // cluster ID
+	r.int32()  // controller ID
+
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		code, name := r.int16(), r.string()
+		r.int8() // is internal
+		leaders := map[int32]int32{}
+		var count int32
+		for m := r.int32(); m > 0 && r.err == nil; m-- {
+			partitionCode, partition, leader := r.int16(), r.int32(), r.int32()
+			r.int32s() // replicas
+			r.int32s() // in-sync replicas
+			if partitionCode == 0 {
+				leaders[partition] = leader
+			}
+			count++
+		}
+		if name != p.cfg.KafkaTopic {
+			continue
+		}
+		if r.err != nil {
+			break
+		}
+		if code != 0 {
+			return "", 0, kafkaError("topic "+name, code)
+		}
+		if count == 0 {
+			return "", 0, fmt.Errorf("topic %s has no partitions", name)
+		}
+
+		h := fnv.New32a()
+		h.Write(key)
+		partition := int32(h.Sum32() % uint32(count))
+		leader, ok := leaders[partition]
+		if !ok || brokers[leader] == "" {
+			return "", 0, kafkaError("partition "+strconv.Itoa(int(partition))+" of "+name, 5)
+		}
+		return brokers[leader], partition, nil
+	}
+	if r.err != nil {
+		return "", 0, fmt.Errorf("invalid metadata response: %s", r.err)
+	}
+	return "", 0, kafkaError("topic "+p.cfg.KafkaTopic, 3)
+}
+
+// produce sends the message to the leader and waits until all the in-sync replicas have it
+func (p *kafkaProducer) produce(ctx context.Context, key []byte, value []byte, t time.Time) error {
+	batch := kafkaRecordBatch(key, value, t)
+
+	var body []byte
+	body = binary.BigEndian.AppendUint16(body, 0xffff) // no transactional ID
+	body = binary.BigEndian.AppendUint16(body, 0xffff) // acks from all the in-sync replicas
+	body = binary.BigEndian.AppendUint32(body, uint32(kafkaProduceTimeout.Milliseconds()))
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = appendKafkaString(body, p.cfg.KafkaTopic)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = binary.BigEndian.AppendUint32(body, uint32(p.partition))
+	body = binary.BigEndian.AppendUint32(body, uint32(len(batch)))
+	body = append(body, batch...)
+
+	resp, err := kafkaRoundTrip(ctx, p.leader, kafkaProduceAPI, kafkaProduceVersion, body)
+	if err != nil {
+		return fmt.Errorf("%s: %s", p.leader, err)
+	}
+	r := &kafkaReader{data: resp}
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		name := r.string()
+		for m := r.int32(); m > 0 && r.err == nil; m-- {
+			partition, code := r.int32(), r.int16()
+			r.int64() // base offset
+			r.int64() // log append time
+			if code != 0 && r.err == nil {
+				return kafkaError("partition "+strconv.Itoa(int(partition))+" of "+name, code)
+			}
+		}
+	}
+	if r.err != nil {
+		return fmt.Errorf("invalid produce response: %s", r.err)
+	}
+	return nil
+}
+
+// kafkaRecordBatch encodes the message as a batch of one record in the v2 format
+func kafkaRecordBatch(key []byte, value []byte, t time.Time) []byte {
+	var record []byte
+	record = append(record, 0)              // attributes
+	record = binary.AppendVarint(record, 0) // timestamp delta
+	record = binary.AppendVarint(record, 0) // offset delta
+	record = binary.AppendVarint(record, int64(len(key)))
+	record = append(record, key...)
+	record = binary.AppendVarint(record, int64(len(value)))
+	record = append(record, value...)
+	record = binary.AppendVarint(record, 0) // headers
+
+	// the part after the checksum
+	var rest []byte
+	rest = binary.BigEndian.AppendUint16(rest, 0) // attributes: no compression, create time
+	rest = binary.BigEndian.AppendUint32(rest, 0) // last offset delta
+	rest = binary.BigEndian.AppendUint64(rest, uint64(t.UnixMilli()))
+	rest = binary.BigEndian.AppendUint64(rest, uint64(t.UnixMilli()))
+	rest = binary.BigEndian.AppendUint64(rest, 0xffffffffffffffff) // no producer ID
+	rest = binary.BigEndian.AppendUint16(rest, 0xffff)             // no producer epoch
+	rest = binary.BigEndian.AppendUint32(rest, 0xffffffff)         // no base sequence
+	rest = binary.BigEndian.AppendUint32(rest, 1)
+	rest = binary.AppendVarint(rest, int64(len(record)))
+	rest = append(rest, record...)
+
+	var batch []byte
+	batch = binary.BigEndian.AppendUint64(batch, 0)                       // base offset, set by the broker
+	batch = binary.BigEndian.AppendUint32(batch, uint32(4+1+4+len(rest))) // length of the rest of the batch
+	batch = binary.BigEndian.AppendUint32(batch, 0xffffffff)              // partition leader epoch
+	batch = append(batch, 2)                                              // magic, the version of the format
+	batch = binary.BigEndian.AppendUint32(batch, crc32.Checksum(rest, crc32c))
+	return append(batch, rest...)
+}
+
+// kafkaRoundTrip sends a request to the broker on a new connection and returns the body of the response
+func kafkaRoundTrip(ctx context.Context, addr string, api int16, version int16, body []byte) ([]byte, error) {
+	// the same timeout as the HTTP channels, so an unreachable broker doesn't block the queue
+	dialer := net.Dialer{Timeout: httpClient.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(httpClient.Timeout))
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	const correlationID = 1
+	var req []byte
+	req = binary.BigEndian.AppendUint32(req, uint32(2+2+4+2+len(kafkaClientID)+len(body)))
+	req = binary.BigEndian.AppendUint16(req, uint16(api))
+	req = binary.BigEndian.AppendUint16(req, uint16(version))
+	req = binary.BigEndian.AppendUint32(req, correlationID)
+	req = appendKafkaString(req, kafkaClientID)
+	req = append(req, body...)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	var header [8]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size < 4 || size > maxKafkaResponseSize {
+		return nil, fmt.Errorf("invalid response size %d", size)
+	}
+	if binary.BigEndian.Uint32(header[4:]) != correlationID {
+		return nil, errors.New("the response doesn't match the request")
+	}
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func kafkaError(what string, code int16) error {
+	if text, ok := kafkaErrors[code]; ok {
+		return fmt.Errorf("%s: %s (error code %d)", what, text, code)
+	}
+	return fmt.Errorf("%s: error code %d", what, code)
+}
+
+func appendKafkaString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// kafkaReader decodes the fields of a response, after the first error it returns zero values
+type kafkaReader struct {
+	data []byte
+	err  error
+}
+
+// kafkaZeros are the bytes of the zero values. Nothing is allocated for the sizes in a malformed response,
+// they can be up to 2 GiB.
+var kafkaZeros [8]byte
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err == nil && (n < 0 || len(r.data) < n) {
+		r.err = io.ErrUnexpectedEOF
+	}
+	if r.err != nil {
+		if n > 0 && n <= len(kafkaZeros) {
+			return kafkaZeros[:n]
+		}
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *kafkaReader) int8() int8   { return int8(r.next(1)[0]) }
+func (r *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(r.next(2))) }
+func (r *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(r.next(4))) }
+func (r *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(r.next(8))) }
+
+// string reads a string or a null string, which is returned as empty
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+// int32s skips an array of int32
+func (r *kafkaReader) int32s() {
+	n := int(r.int32())
+	if n > 0 && n*4 > len(r.data) {
+		r.err = io.ErrUnexpectedEOF
+		return
+	}
+	if n > 0 {
+		r.next(n * 4)
+	}
+}
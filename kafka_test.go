@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// metadataResponse builds a metadata response with one broker and one partition of the topic,
+// replicas is the count of its replicas array
+func metadataResponse(topic string, replicas uint32) []byte {
+	var b []byte
+	b = binary.BigEndian.AppendUint32(b, 0) // throttle time
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = binary.BigEndian.AppendUint32(b, 7)
+	b = appendKafkaString(b, "kafka-1")
+	b = binary.BigEndian.AppendUint32(b, 9092)
+	b = binary.BigEndian.AppendUint16(b, 0xffff) // rack
+	b = binary.BigEndian.AppendUint16(b, 0xffff) // cluster ID
+	b = binary.BigEndian.AppendUint32(b, 7)
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = appendKafkaString(b, topic)
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint32(b, 7)
+	b = binary.BigEndian.AppendUint32(b, replicas)
+	if replicas == 1 {
+		b = binary.BigEndian.AppendUint32(b, 7)
+	}
+	b = binary.BigEndian.AppendUint32(b, 1) // in-sync replicas
+	return binary.BigEndian.AppendUint32(b, 7)
+}
+
+func TestKafkaMetadata(t *testing.T) {
+	p := newKafkaProducer(Config{KafkaTopic: "alerts"})
+	leader, partition, err := p.parseMetadata(metadataResponse("alerts", 1), []byte("app"))
+	if err != nil || leader != "kafka-1:9092" || partition != 0 {
+		t.Errorf("got %q, %d, %v, want the leader of partition 0", leader, partition, err)
+	}
+
+	if _, _, err := p.parseMetadata(metadataResponse("other", 1), []byte("app")); err == nil || !strings.Contains(err.Error(), "doesn't exist") {
+		t.Errorf("a missing topic is not reported: %v", err)
+	}
+}
+
+func TestKafkaMalformedMetadata(t *testing.T) {
+	p := newKafkaProducer(Config{KafkaTopic: "alerts"})
+	response := metadataResponse("alerts", 0x7fffffff)
+	allocs := testing.AllocsPerRun(10, func() {
+		if _, _, err := p.parseMetadata(response, []byte("app")); err == nil {
+			t.Error("a truncated response is accepted")
+		}
+	})
+	if allocs > 20 {
+		t.Errorf("parsing a malformed response made %v allocations", allocs)
+	}
+
+	valid := metadataResponse("alerts", 1)
+	for n := range valid {
+		if _, _, err := p.parseMetadata(valid[:n], []byte("app")); err == nil {
+			t.Errorf("a response cut at %d bytes is accepted", n)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// markdownFlavor is the dialect of Markdown understood by the destination
+type markdownFlavor struct {
+	bold   string
+	escape func(string) string // escapes the text outside of the code blocks
+}
+
+// commonMarkdown is understood by Discord, GitHub and most webhooks
+var commonMarkdown = markdownFlavor{bold: "**", escape: escapeMarkdown}
+
+// slackMarkdown is Slack's mrkdwn
+var slackMarkdown = markdownFlavor{bold: "*", escape: escapeSlack}
+
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "~", `\~`, "`", "\\`", "|", `\|`,
+	"#", `\#`, "[", `\[`, "]", `\]`, "<", `\<`, ">", `\>`)
+
+func escapeMarkdown(text string) string {
+	return markdownEscaper.Replace(text)
+}
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func escapeSlack(text string) string {
+	return slackEscaper.Replace(text)
+}
+
+// renderMarkdown renders the batches of the alert as code blocks, each headed by its first error line in bold,
+// and cuts the text to at most limit bytes
+func renderMarkdown(e email, flavor markdownFlavor, limit int) string {
+	batches := e.batches
+	if len(batches) == 0 {
+		// test and crash alerts
+		batches = []alertBatch{{text: e.text, title: e.title}}
+	}
+
+	var notes string
+	for _, note := range e.notes {
+		notes += "\n_" + flavor.escape(note) + "_"
+	}
+
+	var out string
+	if e.summary != "" {
+		out = "```\n" + strings.TrimRight(e.summary, "\n") + "\n```\n"
+	}
+	for i, batch := range batches {
+		var head string
+		if i > 0 {
+			head = "\n"
+		}
+		if batch.title != "" {
+			head += flavor.bold + flavor.escape(batch.title) + flavor.bold + "\n"
+		}
+		// a code block can't contain its own fence
+		text := strings.ReplaceAll(strings.TrimRight(batch.text, "\n"), "```", "`\u200b``")
+
+		more := ""
+		if i < len(batches)-1 {
+			more = "\n_…" + strconv.Itoa(len(batches)-i-1) + " more batch(es)_"
+		}
+		room := limit - len(out) - len(head) - len("```\n\n```") - len(more) - len(notes)
+		if room <= 0 {
+			break
+		}
+		if len(text) > room {
+			out += head + "```\n" + truncateText(text, room) + "\n```" + more
+			break
+		}
+		out += head + "```\n" + text + "\n```"
+	}
+	return out + notes
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Notifier is a destination of the alerts. Besides the built-in channels, a custom backend can be added
+// in a separate file of the package with registerNotifier, called from its init function.
+type Notifier interface {
+	Notify(ctx context.Context, a Alert) error
+}
+
+// Alert is an alert as it's passed to the notifiers
+type Alert struct {
+	ID       string
+	App      string
+	Host     string
+	Subject  string
+	Severity string // "error", "warning" or "recovered"
+	Count    int    // number of errors
+	Rules    []string
+	Time     time.Time
+	Test     bool   // sent with --send-test
+	HTML     string // the body of the HTML email
+	Text     string // the log lines as plain text
+	Markdown string // the log lines as Markdown code blocks
+
+	email email // the composed alert, the built-in channels route and render its batches themselves
+}
+
+func newAlert(cfg Config, e email) Alert {
+	host, _ := os.Hostname()
+	return Alert{
+		ID:       e.id,
+		App:      cfg.AppName,
+		Host:     host,
+		Subject:  emailSubject(cfg, e),
+		Severity: severityName(e),
+		Count:    e.errorCount,
+		Rules:    e.rules,
+		Time:     e.time,
+		Test:     e.test,
+		HTML:     emailBody(cfg, e),
+		Text:     e.text,
+		Markdown: renderMarkdown(e, commonMarkdown, maxWebhookMarkdownLength),
+		email:    e,
+	}
+}
+
+// severityName returns the highest severity of the alert as it's shown to the receivers
+func severityName(e email) string {
+	if e.severity == severityWarning {
+		return "warning"
+	} else if e.recovered {
+		return "recovered"
+	}
+	return "error"
+}
+
+// senderNotifier adapts a built-in channel to Notifier
+type senderNotifier struct {
+	cfg  Config
+	send func(ctx context.Context, cfg Config, e email) error
+}
+
+func (n senderNotifier) Notify(ctx context.Context, a Alert) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return n.send(ctx, n.cfg, a.email)
+}
+
+type registeredNotifier struct {
+	name     string
+	notifier Notifier
+}
+
+// customNotifiers are added with registerNotifier, they receive every alert after the built-in channels
+var customNotifiers []registeredNotifier
+
+// registerNotifier adds a custom backend. The name is used in ermon's output, in the spool and with --send-test.
+func registerNotifier(name string, n Notifier) {
+	customNotifiers = append(customNotifiers, registeredNotifier{name: name, notifier: n})
+}
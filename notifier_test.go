@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotifyCanceledWhileSending(t *testing.T) {
+	// the webhook doesn't answer until the test is over
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	notifier := &fakeNotifier{}
+	cfg := testConfig(t, notifier, "ERMON_MATCH_PATTERN=ERROR\nERMON_WEBHOOK_URL="+server.URL+"\n")
+	var webhook Notifier
+	for _, c := range alertChannels(cfg) {
+		if c.name == "webhook" {
+			webhook = c.notifier
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := webhook.Notify(ctx, newAlert(cfg, email{id: "test", text: "ERROR\n", errorCount: 1, time: now()}))
+	if err == nil {
+		t.Fatal("the canceled alert is reported as sent")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("sending took %s after the context was canceled", elapsed)
+	}
+}
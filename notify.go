@@ -0,0 +1,15 @@
+package main
+
+import (
+	"context"
+	"strconv"
+)
+
+// sendDesktop shows the alert as a desktop notification with the app name and the number of errors
+func sendDesktop(ctx context.Context, cfg Config, e email) error {
+	body := strconv.Itoa(e.errorCount) + " error(s): " + e.title
+	if e.test || e.recovered {
+		body = e.title
+	}
+	return desktopNotify(ctx, cfg.AppName, body)
+}
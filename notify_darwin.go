@@ -0,0 +1,19 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"os/exec"
+)
+
+const desktopNotifySupported = true
+
+// desktopNotify shows a notification with osascript, the texts are passed as arguments so they don't need escaping
+func desktopNotify(ctx context.Context, title, body string) error {
+	return exec.CommandContext(ctx, "osascript",
+		"-e", "on run argv",
+		"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+		"-e", "end run",
+		title, body).Run()
+}
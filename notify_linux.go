@@ -0,0 +1,15 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"os/exec"
+)
+
+const desktopNotifySupported = true
+
+// desktopNotify shows a notification with notify-send
+func desktopNotify(ctx context.Context, title, body string) error {
+	return exec.CommandContext(ctx, "notify-send", "--app-name=ermon", "--", title, body).Run()
+}
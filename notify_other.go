@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import "context"
+
+const desktopNotifySupported = false
+
+// desktopNotify is a no-op on platforms without a known notification tool
+func desktopNotify(ctx context.Context, title, body string) error { return nil }
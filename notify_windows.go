@@ -0,0 +1,26 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+)
+
+const desktopNotifySupported = true
+
+// toastScript shows a toast notification with the texts from the environment, so they don't need escaping
+const toastScript = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$template = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$texts = $template.GetElementsByTagName('text')
+$texts.Item(0).AppendChild($template.CreateTextNode($env:ERMON_TOAST_TITLE)) > $null
+$texts.Item(1).AppendChild($template.CreateTextNode($env:ERMON_TOAST_BODY)) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('ermon').Show([Windows.UI.Notifications.ToastNotification]::new($template))`
+
+// desktopNotify shows a toast notification using PowerShell
+func desktopNotify(ctx context.Context, title, body string) error {
+	cmd := exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", toastScript)
+	cmd.Env = append(os.Environ(), "ERMON_TOAST_TITLE="+title, "ERMON_TOAST_BODY="+body)
+	return cmd.Run()
+}
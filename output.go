@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// the levels of ermon's own messages, set with ERMON_VERBOSITY
+const (
+	verbosityQuiet = iota // nothing but the echoed lines
+	verbosityError        // errors of ermon, e.g. failed alerts
+	verbosityInfo         // also what ermon does, e.g. the alerts it sends
+)
+
+var verbosityLevels = map[string]int{"quiet": verbosityQuiet, "error": verbosityError, "info": verbosityInfo}
+
+// verbosity and echoSample are set from the config before the input is read
+var verbosity = verbosityInfo
+var echoSample = 1 // echo one in echoSample lines, 0 disables the echo
+var echoedLines atomic.Uint64
+
+// echoLine prints a line of the input, so ermon can sit in a pipe without hiding the logs
+func echoLine(w io.Writer, line string) {
+	if echoSample == 0 {
+		return
+	}
+	if echoSample > 1 && (echoedLines.Add(1)-1)%uint64(echoSample) != 0 {
+		return
+	}
+	fmt.Fprintln(w, line)
+}
+
+// logError prints an error of ermon, unless ERMON_VERBOSITY is quiet
+func logError(a ...interface{}) {
+	if verbosity >= verbosityError {
+		fmt.Println(append([]interface{}{"[ermon]"}, a...)...)
+	}
+}
+
+// logInfo prints what ermon does, unless ERMON_VERBOSITY is quiet or error
+func logInfo(a ...interface{}) {
+	if verbosity >= verbosityInfo {
+		fmt.Println(append([]interface{}{"[ermon]"}, a...)...)
+	}
+}
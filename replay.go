@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replayNotifier prints the alerts instead of sending them, with the time relative to the start of the replay
+type replayNotifier struct {
+	mutex sync.Mutex
+	out   io.Writer
+	start time.Time
+	count int
+}
+
+func (n *replayNotifier) Notify(ctx context.Context, a Alert) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.count++
+	// the ID is random, so it's left out of the subject
+	subject := strings.TrimSuffix(a.Subject, " #"+a.ID)
+	fmt.Fprintf(n.out, "--- alert %d at +%s: %s\n%s", n.count, a.Time.Sub(n.start), subject, a.Text)
+	return nil
+}
+
+// replay feeds the lines of the file to the buffering logic and prints the alerts it would send.
+// Every line starts with its time since the start of the log as a Go duration, e.g. "1m30s ERROR timeout".
+// The clock follows the lines, so the windows and limits behave like they would in real time.
+// The notifier has to be registered before the config is parsed, it's the only channel that is used.
+func replay(cfg Config, path string, notifier *replayNotifier) int {
+	cfg.disableChannels()
+	cfg.SpoolDir, cfg.StatsdAddr = "", ""
+	verbosity = verbosityQuiet
+
+	lines, err := readReplayFile(path, notifier.start)
+	if err != nil {
+		fmt.Println("[ermon] Error reading", path+":", err)
+		return 1
+	}
+
+	// sendEmails reads the clock too, e.g. in the circuit breakers, while the lines move it forward
+	var clock atomic.Int64
+	setClock := func(t time.Time) { clock.Store(t.UnixNano()) }
+	setClock(notifier.start)
+	now = func() time.Time { return time.Unix(0, clock.Load()).In(notifier.start.Location()) }
+	startupTime = notifier.start
+
+	sent := make(chan struct{})
+	go sendEmails(cfg, sent)
+
+	tick := pipelineTick(cfg)
+	nextTick := notifier.start.Add(tick)
+	advance := func(to time.Time) {
+		// the ticks that would have happened before the line
+		for !nextTick.After(to) {
+			setClock(nextTick)
+			if cfg.ExpectRate > 0 {
+				checkExpectedRate(cfg)
+			}
+			sendLogsByEmail(cfg, false)
+			if cfg.RecoveryWindow > 0 {
+				sendRecovery(cfg)
+			}
+			nextTick = nextTick.Add(tick)
+		}
+		setClock(to)
+	}
+	for _, line := range lines {
+		advance(line.Time)
+		processLine(cfg, line)
+	}
+	// the input ends a minute after the last line, e.g. when the app exits
+	advance(now().Add(time.Minute))
+	finalRun = cfg.SendOnExit
+	sendLogsByEmail(cfg, false)
+
+	close(outbox)
+	<-sent
+	return 0
+}
+
+func readReplayFile(path string, start time.Time) ([]LogLine, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []LogLine
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		offset, text, _ := strings.Cut(scanner.Text(), " ")
+		d, err := time.ParseDuration(offset)
+		if err != nil {
+			return nil, fmt.Errorf("line %d must start with its time since the start, e.g. 1m30s: %s", n, err)
+		}
+		if len(lines) > 0 && start.Add(d).Before(lines[len(lines)-1].Time) {
+			return nil, fmt.Errorf("line %d is earlier than the line before it", n)
+		}
+		lines = append(lines, LogLine{Text: text, Time: start.Add(d), Source: filepath.Base(path), Number: uint64(n)})
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the .golden files in testdata")
+
+// TestGolden replays every .log file in testdata and compares the alerts with the .golden file next to it.
+// The .ermon file next to the log, if there is one, is its config.
+func TestGolden(t *testing.T) {
+	logs, err := filepath.Glob(filepath.Join("testdata", "*.log"))
+	if err != nil || len(logs) == 0 {
+		t.Fatal("no .log files found in testdata")
+	}
+	for _, path := range logs {
+		base := strings.TrimSuffix(path, ".log")
+		t.Run(filepath.Base(base), func(t *testing.T) {
+			var out bytes.Buffer
+			notifier := &replayNotifier{out: &out, start: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+			resetState()
+			customNotifiers = []registeredNotifier{{name: "replay", notifier: notifier}}
+			var files []string
+			if _, err := os.Stat(base + ".ermon"); err == nil {
+				files = append(files, base+".ermon")
+			}
+			cfg, err := parseConfig(strings.NewReader("ERMON_APP_NAME=golden\n"), files)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if code := replay(*cfg, path, notifier); code != 0 {
+				t.Fatalf("replay exited with %d", code)
+			}
+
+			if *update {
+				if err := os.WriteFile(base+".golden", out.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			expected, err := os.ReadFile(base + ".golden")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(expected, out.Bytes()) {
+				t.Errorf("the alerts differ from %s\n%s", base+".golden", firstDifference(string(expected), out.String()))
+			}
+		})
+	}
+}
+
+// firstDifference shows the first line that differs between the expected and the actual output
+func firstDifference(expected string, actual string) string {
+	want, got := strings.Split(expected, "\n"), strings.Split(actual, "\n")
+	for i := 0; i < len(want) || i < len(got); i++ {
+		var w, g string
+		if i < len(want) {
+			w = want[i]
+		}
+		if i < len(got) {
+			g = got[i]
+		}
+		if w != g {
+			return fmt.Sprintf("  line %d\n  want: %q\n  got:  %q\n", i+1, w, g)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// handleSignals is a no-op on platforms without SIGUSR1 and SIGUSR2
+func handleSignals() {}
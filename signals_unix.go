@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals sends whatever is buffered when ermon receives SIGUSR1
+// and prints the state of the buffers on SIGUSR2
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	for sig := range signals {
+		if sig == syscall.SIGUSR2 {
+			requestStateDump()
+			continue
+		}
+		logInfo("Received SIGUSR1, sending buffered logs")
+		requestFlush()
+	}
+}
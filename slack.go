@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const slackErrorColor = "#d50200"
+const slackWarningColor = "#de9e31"
+const slackRecoveredColor = "#2eb67d"
+const maxSlackHeaderLength = 150   // Slack's limit for header blocks
+const maxSlackSectionLength = 3000 // Slack's limit for section blocks
+
+var httpClient = &http.Client{Timeout: time.Second * 30}
+
+// sendSlack posts the alert to the Slack webhooks of the matched rules, or to the global one
+func sendSlack(ctx context.Context, cfg Config, e email) error {
+	var failures []string
+	for _, r := range slackRoutes(cfg, e) {
+		if err := postJSON(ctx, r.url, slackPayload(cfg, r.e)); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// slackRoute is the part of the alert that goes to a single webhook
+type slackRoute struct {
+	url string
+	e   email
+}
+
+// slackRoutes splits the alert between the webhooks by the rules matched in each batch.
+// Batches without a rule that has its own webhook go to the global webhook.
+// Test alerts go to all of the webhooks.
+func slackRoutes(cfg Config, e email) []slackRoute {
+	var routes []slackRoute
+	route := func(url string) *slackRoute {
+		for i := range routes {
+			if routes[i].url == url {
+				return &routes[i]
+			}
+		}
+		routes = append(routes, slackRoute{url: url, e: email{id: e.id, title: e.title, time: e.time, test: e.test, recovered: e.recovered}})
+		return &routes[len(routes)-1]
+	}
+
+	ruleWebhooks := map[string]string{}
+	for _, r := range cfg.Rules {
+		if r.slackWebhook != "" {
+			ruleWebhooks[r.name] = r.slackWebhook
+		}
+	}
+
+	if len(ruleWebhooks) == 0 || len(e.batches) == 0 {
+		if cfg.SlackWebhookURL != "" {
+			routes = append(routes, slackRoute{url: cfg.SlackWebhookURL, e: e})
+		}
+		if e.test {
+			for _, r := range cfg.Rules {
+				if r.slackWebhook != "" {
+					route(r.slackWebhook).e = e
+				}
+			}
+		}
+		return routes
+	}
+
+	for _, batch := range e.batches {
+		var urls []string
+		for _, name := range batch.rules {
+			if url := ruleWebhooks[name]; url != "" && !contains(urls, url) {
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) == 0 && cfg.SlackWebhookURL != "" {
+			urls = append(urls, cfg.SlackWebhookURL)
+		}
+		for _, url := range urls {
+			r := route(url)
+			if r.e.text != "" {
+				r.e.text += "…\n"
+			}
+			r.e.text += batch.text
+			r.e.batches = append(r.e.batches, batch)
+			r.e.errorCount += batch.errorCount
+			r.e.severity = max(r.e.severity, batch.severity)
+			for _, name := range batch.rules {
+				if !contains(r.e.rules, name) {
+					r.e.rules = append(r.e.rules, name)
+				}
+			}
+		}
+	}
+	return routes
+}
+
+// slackPayload renders the alert as an attachment, colored by the highest severity of the matched lines
+func slackPayload(cfg Config, e email) map[string]interface{} {
+	color := slackErrorColor
+	if e.severity == severityWarning {
+		color = slackWarningColor
+	} else if e.recovered {
+		color = slackRecoveredColor
+	}
+
+	header := cfg.AppName + " reported " + strconv.Itoa(e.errorCount) + " error(s)"
+	if e.test || e.crash || e.recovered {
+		header = cfg.AppName + ": " + e.title
+	}
+
+	payload := map[string]interface{}{
+		"attachments": []interface{}{
+			map[string]interface{}{
+				"color":    color,
+				"fallback": header,
+				"blocks": []interface{}{
+					map[string]interface{}{
+						"type": "header",
+						"text": map[string]interface{}{"type": "plain_text", "text": truncateText(header, maxSlackHeaderLength)},
+					},
+					map[string]interface{}{
+						"type": "section",
+						"text": map[string]interface{}{"type": "mrkdwn", "text": renderMarkdown(e, slackMarkdown, maxSlackSectionLength)},
+					},
+					map[string]interface{}{
+						"type":     "context",
+						"elements": []interface{}{map[string]interface{}{"type": "plain_text", "text": "Alert " + e.id}},
+					},
+				},
+			},
+		},
+	}
+
+	return payload
+}
+
+// truncateText cuts the text to at most limit bytes, preferably at a line break
+func truncateText(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	const ellipsis = "\n…"
+	if limit < len(ellipsis) {
+		// no room for the ellipsis
+		return strings.ToValidUTF8(text[:max(limit, 0)], "")
+	}
+	text = strings.ToValidUTF8(text[:limit-len(ellipsis)], "")
+	if i := strings.LastIndex(text, "\n"); i > 0 {
+		text = text[:i]
+	}
+	return text + ellipsis
+}
+
+func postJSON(ctx context.Context, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return postRequest(ctx, url, body, nil)
+}
+
+// postRequest posts the JSON body with the extra headers
+func postRequest(ctx context.Context, url string, body []byte, headers []header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, h := range headers {
+		req.Header.Set(h.name, h.value)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
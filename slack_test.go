@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestTruncateText(t *testing.T) {
+	text := "first line\nsecond line\n"
+	for limit := 0; limit <= len(text); limit++ {
+		got := truncateText(text, limit)
+		if len(got) > limit {
+			t.Errorf("truncateText(%q, %d) = %q, longer than the limit", text, limit, got)
+		}
+	}
+	if got := truncateText(text, 16); got != "first line\n…" {
+		t.Errorf("the text isn't cut at the line break: %q", got)
+	}
+	if got := truncateText(text, 2); got != "fi" {
+		t.Errorf("the text without room for the ellipsis: %q", got)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+// smtpConn is kept open while several emails are sent in a row, e.g. a queue of alerts or the spooled ones,
+// so every email doesn't reconnect to the relay. closeSMTP closes it once the queue is empty.
+var smtpConn *smtp.Client
+var smtpNetConn net.Conn // the connection of smtpConn, to interrupt it
+var smtpMutex sync.Mutex
+
+// sendSMTP works like smtp.SendMail, but reuses the open connection if there is one
+func sendSMTP(ctx context.Context, addr string, host string, auth smtp.Auth, from string, to []string, message []byte) error {
+	smtpMutex.Lock()
+	defer smtpMutex.Unlock()
+
+	if smtpConn != nil {
+		// the server may have closed the idle connection in the meantime
+		if err := smtpConn.Reset(); err != nil {
+			smtpConn.Close()
+			smtpConn, smtpNetConn = nil, nil
+		}
+	}
+	if smtpConn == nil {
+		c, conn, err := dialSMTP(ctx, addr, host, auth)
+		if err != nil {
+			return err
+		}
+		smtpConn, smtpNetConn = c, conn
+	}
+
+	// the message is abandoned when the context is canceled, e.g. on ERMON_SHUTDOWN_TIMEOUT
+	conn := smtpNetConn
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	err := sendSMTPMessage(smtpConn, from, to, message)
+	stop()
+	if err != nil {
+		// the connection is in an unknown state
+		smtpConn.Close()
+		smtpConn, smtpNetConn = nil, nil
+	}
+	return err
+}
+
+// dialSMTP connects to the server and authenticates the same way smtp.SendMail does
+func dialSMTP(ctx context.Context, addr string, host string, auth smtp.Auth) (*smtp.Client, net.Conn, error) {
+	// the same timeout as the HTTP channels, so a hanging relay doesn't block the queue
+	dialer := net.Dialer{Timeout: httpClient.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(auth); err != nil {
+				c.Close()
+				return nil, nil, err
+			}
+		}
+	}
+	return c, conn, nil
+}
+
+func sendSMTPMessage(c *smtp.Client, from string, to []string, message []byte) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// closeSMTP closes the open SMTP connection, if there is one
+func closeSMTP() {
+	smtpMutex.Lock()
+	defer smtpMutex.Unlock()
+	if smtpConn != nil {
+		smtpConn.Quit()
+		smtpConn, smtpNetConn = nil, nil
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"time"
+)
+
+const socketTimeout = time.Second * 5
+
+// socketAlert is the JSON object written to ERMON_SOCKET and produced to ERMON_KAFKA_TOPIC for every alert
+type socketAlert struct {
+	ID         string   `json:"id"`
+	App        string   `json:"app"`
+	Time       string   `json:"time"`
+	Subject    string   `json:"subject"`
+	Severity   string   `json:"severity"`
+	ErrorCount int      `json:"error_count"`
+	Rules      []string `json:"rules,omitempty"`
+	Text       string   `json:"text"`
+	Test       bool     `json:"test,omitempty"`
+}
+
+// sendSocket writes the alert as a single line of JSON to the Unix socket.
+// A new connection is made for every alert, so a restarted reader doesn't need any special handling.
+func sendSocket(ctx context.Context, cfg Config, e email) error {
+	body, err := alertJSON(cfg, e)
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{Timeout: socketTimeout}
+	conn, err := dialer.DialContext(ctx, "unix", cfg.SocketPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(socketTimeout))
+	_, err = conn.Write(append(body, '\n'))
+	return err
+}
+
+func alertJSON(cfg Config, e email) ([]byte, error) {
+	return json.Marshal(socketAlert{
+		ID:         e.id,
+		App:        cfg.AppName,
+		Time:       e.time.In(cfg.Location).Format(time.RFC3339),
+		Subject:    emailSubject(cfg, e),
+		Severity:   severityName(e),
+		ErrorCount: e.errorCount,
+		Rules:      e.rules,
+		Text:       e.text,
+		Test:       e.test,
+	})
+}
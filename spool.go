@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const spoolRetryInterval = time.Minute
+
+// spooledAlert is an alert that couldn't be sent through some of the channels, stored in ERMON_SPOOL_DIR
+type spooledAlert struct {
+	ID            string         `json:"id"`
+	Thread        string         `json:"thread,omitempty"`
+	Errors        string         `json:"errors"`
+	ErrorCount    int            `json:"error_count"`
+	PreviousCount int            `json:"previous_count,omitempty"`
+	Title         string         `json:"title"`
+	Time          time.Time      `json:"time"`
+	Text          string         `json:"text"`
+	Severity      int            `json:"severity"`
+	Rules         []string       `json:"rules,omitempty"`
+	Triggers      []string       `json:"triggers,omitempty"`
+	Batches       []spooledBatch `json:"batches,omitempty"`
+	Notes         []string       `json:"notes,omitempty"`
+	Recovered     bool           `json:"recovered,omitempty"`
+	Test          bool           `json:"test,omitempty"`
+	Crash         bool           `json:"crash,omitempty"`
+	Escalations   []string       `json:"escalations,omitempty"`
+	Summary       string         `json:"summary,omitempty"`
+	Channels      []string       `json:"channels"` // the channels the alert still has to be sent through
+}
+
+type spooledBatch struct {
+	Text       string   `json:"text"`
+	Title      string   `json:"title,omitempty"`
+	ErrorCount int      `json:"error_count"`
+	Severity   int      `json:"severity"`
+	Rules      []string `json:"rules,omitempty"`
+}
+
+// spoolAlert writes the alert to the spool directory and removes the oldest alerts above ERMON_SPOOL_MAX
+func spoolAlert(cfg Config, e email, channels []string) error {
+	a := spooledAlert{ID: e.id, Thread: e.thread, Errors: e.errors, ErrorCount: e.errorCount, PreviousCount: e.previousCount, Title: e.title, Time: e.time,
+		Text: e.text, Severity: e.severity, Rules: e.rules, Triggers: e.triggers, Notes: e.notes, Recovered: e.recovered, Test: e.test, Crash: e.crash,
+		Escalations: e.escalations, Summary: e.summary, Channels: channels}
+	for _, b := range e.batches {
+		a.Batches = append(a.Batches, spooledBatch{Text: b.text, Title: b.title, ErrorCount: b.errorCount, Severity: b.severity, Rules: b.rules})
+	}
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so a crash doesn't leave a partial alert behind
+	path := filepath.Join(cfg.SpoolDir, e.id+".json")
+	if err := os.WriteFile(path+".tmp", body, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	paths, err := spooledAlerts(cfg)
+	if err != nil {
+		return err
+	}
+	for len(paths) > cfg.SpoolMax {
+		logError("Spool is full, dropping the oldest alert", filepath.Base(paths[0]))
+		os.Remove(paths[0])
+		paths = paths[1:]
+	}
+	return nil
+}
+
+// spooledAlerts returns the paths of the spooled alerts, oldest first
+func spooledAlerts(cfg Config) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(cfg.SpoolDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	// the IDs start with the time, so they sort by age
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// loadSpooledAlert reads a spooled alert and the channels it has to be sent through
+func loadSpooledAlert(path string) (email, []string, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return email{}, nil, err
+	}
+	var a spooledAlert
+	if err := json.Unmarshal(body, &a); err != nil {
+		return email{}, nil, err
+	}
+	e := email{id: a.ID, thread: a.Thread, errors: a.Errors, errorCount: a.ErrorCount, previousCount: a.PreviousCount, title: a.Title, time: a.Time,
+		text: a.Text, severity: a.Severity, rules: a.Rules, triggers: a.Triggers, notes: a.Notes, recovered: a.Recovered, test: a.Test, crash: a.Crash,
+		escalations: a.Escalations, summary: a.Summary}
+	for _, b := range a.Batches {
+		e.batches = append(e.batches, alertBatch{text: b.Text, title: b.Title, errorCount: b.ErrorCount, severity: b.Severity, rules: b.Rules})
+	}
+	return e, a.Channels, nil
+}
+
+// retrySpool sends the spooled alerts through the channels that failed before,
+// removing the ones that are sent and keeping the channels that failed again
+func retrySpool(cfg Config, send func(e email, channels []string) []string) {
+	paths, err := spooledAlerts(cfg)
+	if err != nil {
+		logError("Error reading spool:", err)
+		return
+	}
+	for _, path := range paths {
+		e, channels, err := loadSpooledAlert(path)
+		if err != nil {
+			logError("Removing invalid spooled alert", filepath.Base(path)+":", err)
+			os.Remove(path)
+			continue
+		}
+
+		logInfo("Retrying spooled alert", e.id, "via", strings.Join(channels, ", "))
+		failed := send(e, channels)
+		if len(failed) == 0 {
+			os.Remove(path)
+		} else if len(failed) < len(channels) {
+			if err := spoolAlert(cfg, e, failed); err != nil {
+				logError("Error spooling alert:", err)
+			}
+		}
+	}
+}
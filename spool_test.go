@@ -0,0 +1,35 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSpoolRoundTrip(t *testing.T) {
+	cfg := testConfig(t, &fakeNotifier{}, "ERMON_MATCH_PATTERN=ERROR\nERMON_SHOW_TRIGGER=true\nERMON_SPOOL_DIR="+t.TempDir()+"\n")
+	alerts := []email{
+		{id: "20240101120000-abcd", thread: "20240101110000-dcba", errors: "<span>ERROR db down</span>\n", errorCount: 2, previousCount: 1,
+			title: "ERROR db down", time: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), text: "ERROR db down\n", severity: severityError,
+			rules: []string{"Database"}, triggers: []string{"Database"}, notes: []string{"1 more line(s) matched"}, escalations: []string{"Database"},
+			summary: "2 errors", batches: []alertBatch{{text: "ERROR db down\n", title: "ERROR db down", errorCount: 2, severity: severityError, rules: []string{"Database"}}}},
+		{id: "20240101120000-test", errors: "test\n", errorCount: 1, title: "test", time: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), text: "test\n", test: true},
+		{id: "20240101120000-crsh", errors: "panic\n", errorCount: 1, title: "panic", time: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), text: "panic\n", crash: true},
+	}
+	for _, e := range alerts {
+		if err := spoolAlert(cfg, e, []string{"email"}); err != nil {
+			t.Fatal(err)
+		}
+		loaded, channels, err := loadSpooledAlert(filepath.Join(cfg.SpoolDir, e.id+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(loaded, e) || !reflect.DeepEqual(channels, []string{"email"}) {
+			t.Errorf("the spooled alert changed:\n%+v\n%+v", e, loaded)
+		}
+		if emailBody(cfg, loaded) != emailBody(cfg, e) || emailSubject(cfg, loaded) != emailSubject(cfg, e) {
+			t.Errorf("the spooled alert %s is rendered differently", e.id)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// counted by the sender goroutine, read by the pipeline
+var alertsSent atomic.Uint64
+var alertFailures atomic.Uint64
+
+// statsdClient pushes the counters as deltas since the previous report, and the buffer sizes as gauges
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	last   map[string]uint64
+}
+
+func newStatsdClient(cfg Config) (*statsdClient, error) {
+	conn, err := net.Dial("udp", cfg.StatsdAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdClient{conn: conn, prefix: cfg.StatsdPrefix, last: map[string]uint64{}}, nil
+}
+
+// report sends the metrics in a single packet, it must be called from the pipeline goroutine
+func (c *statsdClient) report() {
+	counters := []struct {
+		name  string
+		value uint64
+	}{
+		{"lines", stats.lines},
+		{"errors", stats.errors},
+		{"ignored", stats.ignored},
+		{"alerts.sent", alertsSent.Load()},
+		{"alerts.failed", alertFailures.Load()},
+	}
+
+	var metrics []string
+	for _, counter := range counters {
+		metrics = append(metrics, fmt.Sprintf("%s%s:%d|c", c.prefix, counter.name, counter.value-c.last[counter.name]))
+		c.last[counter.name] = counter.value
+	}
+	metrics = append(metrics,
+		fmt.Sprintf("%sbuffer.lines:%d|g", c.prefix, len(logBuffer)),
+		fmt.Sprintf("%sbuffer.batches:%d|g", c.prefix, len(emailBuffer)),
+		fmt.Sprintf("%sbuffer.outbox:%d|g", c.prefix, len(outbox)),
+	)
+
+	// UDP is fire and forget, so errors are rare, e.g. when the network is unreachable
+	if _, err := c.conn.Write([]byte(strings.Join(metrics, "\n"))); err != nil {
+		logError("StatsD error:", err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const maxWebhookMarkdownLength = 65536
+
+// defaultWebhookTemplate is used when ERMON_WEBHOOK_TEMPLATE is not set
+const defaultWebhookTemplate = `{"id": {{json .ID}}, "app": {{json .App}}, "host": {{json .Host}}, "subject": {{json .Subject}}, "severity": {{json .Severity}}, "count": {{.Count}}, "lines": {{json .Lines}}}`
+
+// webhookData is available in ERMON_WEBHOOK_TEMPLATE
+type webhookData struct {
+	ID       string
+	App      string
+	Host     string
+	Subject  string
+	Severity string // "error", "warning" or "recovered"
+	Count    int
+	Lines    []string
+	Markdown string // the lines as Markdown code blocks
+	Rules    []string
+	Time     time.Time
+	Test     bool
+}
+
+// parseWebhookTemplate parses the template and makes sure it renders valid JSON
+func parseWebhookTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("webhook").Funcs(template.FuncMap{
+		// json renders any value as JSON, so strings are quoted and escaped
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	// the sample values have quotes, so unescaped strings render invalid JSON
+	var sample bytes.Buffer
+	err = tmpl.Execute(&sample, webhookData{ID: `"id"`, App: `"app"`, Host: `"host"`, Subject: `"subject"`, Severity: "error",
+		Count: 1, Lines: []string{`"line"`}, Markdown: `"markdown"`, Rules: []string{`"rule"`}, Time: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(sample.Bytes()) {
+		return nil, fmt.Errorf("the template doesn't render valid JSON, use {{json .Value}} to render strings: %s", sample.String())
+	}
+	return tmpl, nil
+}
+
+// sendWebhook posts the alert to ERMON_WEBHOOK_URL
+func sendWebhook(ctx context.Context, cfg Config, e email) error {
+	return postWebhook(ctx, cfg, cfg.WebhookURL, e)
+}
+
+// postWebhook renders the alert with ERMON_WEBHOOK_TEMPLATE and posts it to the URL
+func postWebhook(ctx context.Context, cfg Config, url string, e email) error {
+	body, err := renderWebhook(cfg.WebhookTemplate, newAlert(cfg, e))
+	if err != nil {
+		return err
+	}
+	return postRequest(ctx, url, body, nil)
+}
+
+func renderWebhook(tmpl *template.Template, a Alert) ([]byte, error) {
+	var body bytes.Buffer
+	err := tmpl.Execute(&body, webhookData{
+		ID:       a.ID,
+		App:      a.App,
+		Host:     a.Host,
+		Subject:  a.Subject,
+		Severity: a.Severity,
+		Count:    a.Count,
+		Lines:    strings.Split(strings.TrimRight(a.Text, "\n"), "\n"),
+		Markdown: a.Markdown,
+		Rules:    a.Rules,
+		Time:     a.Time,
+		Test:     a.Test,
+	})
+	return body.Bytes(), err
+}
+
+// webhookDestination is one of the ERMON_WEBHOOK_<n>_URL webhooks
+type webhookDestination struct {
+	url      string
+	format   string             // "json", "slack" or "template"
+	template *template.Template // for "json" and "template"
+	headers  []header
+}
+
+// webhookNotifier posts the alerts to a webhookDestination in its format
+type webhookNotifier struct {
+	cfg  Config
+	dest webhookDestination
+}
+
+func (n webhookNotifier) Notify(ctx context.Context, a Alert) error {
+	var body []byte
+	var err error
+	if n.dest.format == "slack" {
+		body, err = json.Marshal(slackPayload(n.cfg, a.email))
+	} else {
+		body, err = renderWebhook(n.dest.template, a)
+	}
+	if err != nil {
+		return err
+	}
+	return postRequest(ctx, n.dest.url, body, n.dest.headers)
+}